@@ -8,13 +8,19 @@ import (
 )
 
 type Config struct {
-	FrontendURL     string `yaml:"frontend-url"`
-	CoreURL         string `yaml:"core-url"`
-	RedditClientURL string `yaml:"reddit-client-url"`
-	RedirectURI     string `yaml:"redirect-uri"`
-	RedditSecret    string `yaml:"reddit-secret"`
-	RedditClientID  string `yaml:"reddit-client-id"`
-	RedditOAuthURL  string `yaml:"reddit-oauth-url"`
+	FrontendURL          string   `yaml:"frontend-url"`
+	CoreURL              string   `yaml:"core-url"`
+	RedditClientURL      string   `yaml:"reddit-client-url"`
+	RedirectURI          string   `yaml:"redirect-uri"`
+	RedditSecret         string   `yaml:"reddit-secret"`
+	RedditClientID       string   `yaml:"reddit-client-id"`
+	RedditOAuthURL       string   `yaml:"reddit-oauth-url"`
+	RedditAuthURL        string   `yaml:"reddit-auth-url"`
+	DataPath             string   `yaml:"data-path"`
+	LinkPreviewCachePath string   `yaml:"link-preview-cache-path"`
+	CursorSecret         string   `yaml:"cursor-secret"`
+	WebhookURLs          []string `yaml:"webhook-urls"`
+	WebhookSecret        string   `yaml:"webhook-secret"`
 }
 
 // TODO: Add validation to avoid empty values
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	voteEndpoint   = "/api/vote"
+	saveEndpoint   = "/api/save"
+	unsaveEndpoint = "/api/unsave"
+	hideEndpoint   = "/api/hide"
+	unhideEndpoint = "/api/unhide"
+
+	// Reddit prefixes the ids of links (posts) with this to form a fullname
+	linkPrefix = "t3_"
+)
+
+// Maps the directions we accept to the values expected by Reddit's /api/vote
+var voteDirections = map[string]string{
+	"up":    "1",
+	"down":  "-1",
+	"clear": "0",
+}
+
+// Body of a request to vote on a post
+type VoteRequest struct {
+	AuthRequest
+	Direction string `json:"direction"`
+}
+
+// Returns the fullname of the post with the given id, ids that are already fullnames are left alone
+func postFullname(postID string) string {
+	if strings.HasPrefix(postID, linkPrefix) {
+		return postID
+	}
+	return linkPrefix + postID
+}
+
+// Creates a request to the Reddit oauth api for the given endpoint, form values are sent urlencoded in the body
+func (api *CoreHandler) newRedditRequest(method, endpoint, token string, form url.Values) (*http.Request, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, api.conf.RedditOAuthURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if form != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	// Attach our bearer token
+	req.Header.Add("Authorization", "bearer "+token)
+	// This is required by the Reddit API terms and conditions
+	req.Header.Add("User-Agent", userAgent)
+
+	return req, nil
+}
+
+// Sends the form to the given Reddit endpoint on behalf of the user, refreshing their token if required
+// Returns the body of the response from Reddit, anything other than a 200 is returned as a redditStatusError
+func (api *CoreHandler) postRedditForm(auth *AuthRequest, userID, endpoint string, form url.Values) ([]byte, error) {
+	req, err := api.newRedditRequest(http.MethodPost, endpoint, auth.BearerToken, form)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := api.completeRequest(auth, userID, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	log.Printf("Received response from Reddit with status code: %v while posting to %v", resp.StatusCode, endpoint)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRedditStatusError(resp.StatusCode, body)
+	}
+
+	return body, nil
+}
+
+// Performs an action on the post given in the path that only requires the posts fullname
+func (api *CoreHandler) postAction(w http.ResponseWriter, r *http.Request, endpoint string) {
+	vars := mux.Vars(r)
+
+	auth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if auth.BearerToken == "" {
+		http.Error(w, "a reddit account must be linked", http.StatusUnauthorized)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("id", postFullname(vars["postID"]))
+	if _, err := api.postRedditForm(auth, vars["id"], endpoint, form); err != nil {
+		log.Printf("Unable to complete %v for post %v: %v", endpoint, vars["postID"], err)
+		writeRedditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Votes on a post, direction must be one of up, down or clear
+// POST /v1/{id}/posts/{postID}/vote
+func (api *CoreHandler) Vote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vote := &VoteRequest{}
+	if err := json.Unmarshal(body, vote); err != nil {
+		log.Printf("Received invalid vote request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if vote.BearerToken == "" {
+		http.Error(w, "a reddit account must be linked", http.StatusUnauthorized)
+		return
+	}
+
+	dir, ok := voteDirections[vote.Direction]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid vote direction: %q", vote.Direction), http.StatusBadRequest)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("id", postFullname(vars["postID"]))
+	form.Set("dir", dir)
+	if _, err := api.postRedditForm(&vote.AuthRequest, vars["id"], voteEndpoint, form); err != nil {
+		log.Printf("Unable to vote on post %v: %v", vars["postID"], err)
+		writeRedditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// POST /v1/{id}/posts/{postID}/save
+func (api *CoreHandler) Save(w http.ResponseWriter, r *http.Request) {
+	api.postAction(w, r, saveEndpoint)
+}
+
+// POST /v1/{id}/posts/{postID}/unsave
+func (api *CoreHandler) Unsave(w http.ResponseWriter, r *http.Request) {
+	api.postAction(w, r, unsaveEndpoint)
+}
+
+// POST /v1/{id}/posts/{postID}/hide
+func (api *CoreHandler) Hide(w http.ResponseWriter, r *http.Request) {
+	api.postAction(w, r, hideEndpoint)
+}
+
+// POST /v1/{id}/posts/{postID}/unhide
+func (api *CoreHandler) Unhide(w http.ResponseWriter, r *http.Request) {
+	api.postAction(w, r, unhideEndpoint)
+}
@@ -7,6 +7,33 @@ import (
 type CoreAPI interface {
 	GetPosts(w http.ResponseWriter, r *http.Request)
 	GetPostsNoAuth(w http.ResponseWriter, r *http.Request)
+	GetPost(w http.ResponseWriter, r *http.Request)
+	GetPopular(w http.ResponseWriter, r *http.Request)
+	GetAll(w http.ResponseWriter, r *http.Request)
+	GetPostsByID(w http.ResponseWriter, r *http.Request)
+	GetTimeline(w http.ResponseWriter, r *http.Request)
+	Stream(w http.ResponseWriter, r *http.Request)
 	Authorize(w http.ResponseWriter, r *http.Request)
 	AuthorizeCallback(w http.ResponseWriter, r *http.Request)
+	Vote(w http.ResponseWriter, r *http.Request)
+	Save(w http.ResponseWriter, r *http.Request)
+	Unsave(w http.ResponseWriter, r *http.Request)
+	Hide(w http.ResponseWriter, r *http.Request)
+	Unhide(w http.ResponseWriter, r *http.Request)
+	GetSubreddits(w http.ResponseWriter, r *http.Request)
+	GetSubreddit(w http.ResponseWriter, r *http.Request)
+	GetUser(w http.ResponseWriter, r *http.Request)
+	GetMe(w http.ResponseWriter, r *http.Request)
+	Submit(w http.ResponseWriter, r *http.Request)
+	Reply(w http.ResponseWriter, r *http.Request)
+	GetFilterSettings(w http.ResponseWriter, r *http.Request)
+	UpdateFilterSettings(w http.ResponseWriter, r *http.Request)
+	GetMuteRules(w http.ResponseWriter, r *http.Request)
+	CreateMuteRule(w http.ResponseWriter, r *http.Request)
+	UpdateMuteRule(w http.ResponseWriter, r *http.Request)
+	DeleteMuteRule(w http.ResponseWriter, r *http.Request)
+	GetWatches(w http.ResponseWriter, r *http.Request)
+	CreateWatch(w http.ResponseWriter, r *http.Request)
+	UpdateWatch(w http.ResponseWriter, r *http.Request)
+	DeleteWatch(w http.ResponseWriter, r *http.Request)
 }
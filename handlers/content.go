@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	contentFormatHTML     = "html"
+	contentFormatMarkdown = "markdown"
+	contentFormatText     = "text"
+
+	defaultExcerptLength = 280
+	maxExcerptLength     = 2000
+	ellipsis             = "…"
+)
+
+var contentFormats = map[string]bool{
+	contentFormatHTML:     true,
+	contentFormatMarkdown: true,
+	contentFormatText:     true,
+}
+
+// Elements that should be separated from the surrounding text when converted to plain text
+var blockElements = map[atom.Atom]bool{
+	atom.Blockquote: true,
+	atom.Br:         true,
+	atom.Div:        true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Hr:         true,
+	atom.Li:         true,
+	atom.Ol:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Table:      true,
+	atom.Tr:         true,
+	atom.Ul:         true,
+}
+
+func parseContentFormat(format string) (string, error) {
+	if format == "" {
+		return contentFormatHTML, nil
+	}
+	if !contentFormats[format] {
+		return "", fmt.Errorf("content_format must be one of html, markdown or text")
+	}
+	return format, nil
+}
+
+// Parses sanitized html into a root node that can be walked and rendered
+func parseContentFragment(content string) (*html.Node, error) {
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(content), root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	return root, nil
+}
+
+func renderContentFragment(root *html.Node) (string, error) {
+	var buf bytes.Buffer
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// Converts sanitized html into plain text keeping paragraphs on separate lines
+func htmlToText(content string) string {
+	root, err := parseContentFragment(content)
+	if err != nil {
+		log.Printf("Unable to parse html content: %v", err)
+		return ""
+	}
+
+	var buf bytes.Buffer
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.TextNode:
+				buf.WriteString(c.Data)
+			case html.ElementNode:
+				walk(c)
+				if blockElements[c.DataAtom] {
+					buf.WriteString("\n")
+				}
+			}
+		}
+	}
+	walk(root)
+
+	// Collapse the blank lines left behind by nested block elements
+	lines := []string{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Cuts the text down to at most limit characters without splitting a word, returns whether anything was cut
+func truncateWords(text string, limit int) (string, bool) {
+	if utf8.RuneCountInString(text) <= limit {
+		return text, false
+	}
+
+	runes := []rune(text)
+	cut := limit
+	// Walk back to the start of the word we landed in, if the limit is on a boundary we can cut there
+	for cut > 0 && !unicode.IsSpace(runes[cut]) {
+		cut--
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace), true
+}
+
+// Builds an excerpt of plain text or markdown content
+func getTextExcerpt(text string, limit int) string {
+	excerpt, cut := truncateWords(text, limit)
+	if cut && excerpt == "" {
+		// The first word is longer than the limit so we have no choice but to split it
+		excerpt = string([]rune(text)[:limit])
+	}
+	if cut {
+		excerpt += ellipsis
+	}
+	return excerpt
+}
+
+// Builds an excerpt of sanitized html content, counting only visible text towards the limit.
+// Elements are never cut in half so the result is always well formed
+func getHTMLExcerpt(content string, limit int) string {
+	root, err := parseContentFragment(content)
+	if err != nil {
+		log.Printf("Unable to parse html content: %v", err)
+		return ""
+	}
+
+	remaining := limit
+	truncated := false
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if truncated {
+				n.RemoveChild(c)
+				c = next
+				continue
+			}
+
+			switch c.Type {
+			case html.TextNode:
+				text, cut := truncateWords(c.Data, remaining)
+				remaining -= utf8.RuneCountInString(text)
+				if cut {
+					c.Data = text + ellipsis
+					truncated = true
+				}
+			case html.ElementNode:
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(root)
+
+	excerpt, err := renderContentFragment(root)
+	if err != nil {
+		log.Printf("Unable to render html content: %v", err)
+		return ""
+	}
+	return excerpt
+}
+
+// Gets a self posts content and excerpt in the requested format
+func getContent(post RedditPost, format string, excerptLength int) (content string, excerpt string) {
+	sanitized := getContentHTML(post.Content)
+
+	switch format {
+	case contentFormatMarkdown:
+		content = html.UnescapeString(post.SelfText)
+		excerpt = getTextExcerpt(content, excerptLength)
+	case contentFormatText:
+		content = htmlToText(sanitized)
+		excerpt = getTextExcerpt(content, excerptLength)
+	default:
+		content = sanitized
+		excerpt = getHTMLExcerpt(content, excerptLength)
+	}
+	return content, excerpt
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/url"
+)
+
+const selfPostHTML = `&lt;!-- SC_OFF --&gt;&lt;div class="md"&gt;&lt;p&gt;First paragraph with &lt;strong&gt;bold words&lt;/strong&gt; inside.&lt;/p&gt;
+
+&lt;ul&gt;
+&lt;li&gt;one&lt;/li&gt;
+&lt;li&gt;two&lt;/li&gt;
+&lt;/ul&gt;
+&lt;/div&gt;&lt;!-- SC_ON --&gt;`
+
+func (s *HandlersTestSuite) TestHTMLToText() {
+	s.Equal("First paragraph with bold words inside.\none\ntwo", htmlToText(getContentHTML(selfPostHTML)))
+}
+
+func (s *HandlersTestSuite) TestGetTextExcerpt() {
+	// Short text should be left alone
+	s.Equal("hello world", getTextExcerpt("hello world", 20))
+
+	// Text should be cut at the last word that fits
+	s.Equal("hello…", getTextExcerpt("hello world", 8))
+	s.Equal("hello…", getTextExcerpt("hello world", 5))
+
+	// A single long word has to be split
+	s.Equal("hel…", getTextExcerpt("helloworld", 3))
+}
+
+func (s *HandlersTestSuite) TestGetHTMLExcerpt() {
+	// Tags should be closed and only text counted against the limit
+	s.Equal(`<div class="md"><p>First paragraph with <strong>bold…</strong></p></div>`,
+		getHTMLExcerpt(getContentHTML(selfPostHTML), 27))
+}
+
+func (s *HandlersTestSuite) TestGetContent() {
+	post := RedditPost{Content: selfPostHTML, SelfText: "First paragraph with **bold words** inside.\n\n* one\n* two"}
+
+	content, excerpt := getContent(post, contentFormatMarkdown, 15)
+	s.Equal(post.SelfText, content)
+	s.Equal("First paragraph…", excerpt)
+
+	content, _ = getContent(post, contentFormatText, 15)
+	s.Equal("First paragraph with bold words inside.\none\ntwo", content)
+
+	content, _ = getContent(post, contentFormatHTML, 15)
+	s.Contains(content, "<strong>bold words</strong>")
+
+	// Link posts have no content
+	content, excerpt = getContent(RedditPost{}, contentFormatHTML, 15)
+	s.Equal("", content)
+	s.Equal("", excerpt)
+}
+
+func (s *HandlersTestSuite) TestGetPostOptions() {
+	opts, err := getPostOptions(url.Values{})
+	s.Nil(err)
+	s.Equal(contentFormatHTML, opts.contentFormat)
+	s.Equal(defaultExcerptLength, opts.excerptLength)
+
+	opts, err = getPostOptions(url.Values{"content_format": {"text"}, "excerpt_length": {"100"}})
+	s.Nil(err)
+	s.Equal(contentFormatText, opts.contentFormat)
+	s.Equal(100, opts.excerptLength)
+
+	_, err = getPostOptions(url.Values{"content_format": {"pdf"}})
+	s.NotNil(err)
+	_, err = getPostOptions(url.Values{"excerpt_length": {"0"}})
+	s.NotNil(err)
+}
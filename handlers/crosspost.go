@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"golang.org/x/net/html"
+)
+
+// Reference to the post a crosspost was made from
+type CrosspostRef struct {
+	ID        string `json:"id"`
+	Author    string `json:"author"`
+	Title     string `json:"title"`
+	Subreddit string `json:"subreddit"`
+	PostLink  string `json:"postLink"`
+}
+
+// Crossposts carry none of the original posts media so we copy it over from the original.
+// Returns the resolved post and a reference to the original, or nil if the post isn't a crosspost
+func resolveCrosspost(post RedditPost) (RedditPost, *CrosspostRef) {
+	if len(post.CrosspostParentList) == 0 {
+		return post, nil
+	}
+	parent := post.CrosspostParentList[0]
+
+	post.URL = parent.URL
+	post.Domain = parent.Domain
+	post.Thumbnail = parent.Thumbnail
+	post.Preview = parent.Preview
+	post.IsVideo = parent.IsVideo
+	post.IsSelf = parent.IsSelf
+	post.Media = parent.Media
+	post.SecureMedia = parent.SecureMedia
+	post.MediaEmbed = parent.MediaEmbed
+	post.SecureMediaEmbed = parent.SecureMediaEmbed
+	post.PostHint = parent.PostHint
+	post.IsGallery = parent.IsGallery
+	post.GalleryData = parent.GalleryData
+	post.MediaMetadata = parent.MediaMetadata
+	post.Content = parent.Content
+	post.SelfText = parent.SelfText
+	// The original may be marked sensitive even if the crosspost isn't
+	post.Over18 = post.Over18 || parent.Over18
+	post.Spoiler = post.Spoiler || parent.Spoiler
+	post.CrosspostParentList = nil
+
+	return post, &CrosspostRef{
+		ID:        parent.ID,
+		Author:    parent.Author,
+		Title:     html.UnescapeString(parent.Title),
+		Subreddit: parent.Subreddit,
+		PostLink:  redditBaseURL + parent.RelativePath,
+	}
+}
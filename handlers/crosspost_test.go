@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+)
+
+func (s *HandlersTestSuite) TestResolveCrosspost() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"id": "cross",
+		"title": "Look at this",
+		"subreddit": "aww",
+		"url": "/r/pics/comments/orig/a_dog/",
+		"preview": {"images": []},
+		"crosspost_parent": "t3_orig",
+		"crosspost_parent_list": [{
+			"id": "orig",
+			"author": "op",
+			"title": "A dog &amp; a cat",
+			"subreddit": "pics",
+			"permalink": "/r/pics/comments/orig/a_dog/",
+			"url": "https://i.redd.it/dog.jpg",
+			"domain": "i.redd.it",
+			"over_18": true,
+			"preview": {"images": [{"source": {"url": "https://preview.redd.it/dog.jpg", "width": 800}}]}
+		}]
+	}`), &post))
+
+	resolved, ref := resolveCrosspost(post)
+	s.NotNil(ref)
+	s.Equal("orig", ref.ID)
+	s.Equal("pics", ref.Subreddit)
+	s.Equal("A dog & a cat", ref.Title)
+	s.Equal("https://www.reddit.com/r/pics/comments/orig/a_dog/", ref.PostLink)
+
+	// The crosspost keeps its own identity but takes the originals media
+	s.Equal("cross", resolved.ID)
+	s.Equal("aww", resolved.Subreddit)
+	s.Equal("https://i.redd.it/dog.jpg", resolved.URL)
+	s.Len(resolved.Preview.Images, 1)
+	s.True(resolved.Over18)
+
+	// Hero images should now show up for crossposts
+	generic, ok := newPost(post, &postOptions{targetWidth: targetImageWidth, filters: FilterSettings{NSFW: filterShow}})
+	s.True(ok)
+	s.Equal("https://preview.redd.it/dog.jpg", generic.HeroImg)
+	s.Equal("orig", generic.CrosspostedFrom.ID)
+
+	// Regular posts are left alone
+	_, ref = resolveCrosspost(RedditPost{ID: "plain"})
+	s.Nil(ref)
+}
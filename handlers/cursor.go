@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// How long a client can hold on to a cursor before it must start from the first page again
+const cursorTTL = 6 * time.Hour
+
+var errInvalidCursor = errors.New("invalid or expired continue token")
+
+// Everything we need to fetch the next page of a listing. Clients only ever see it signed and encoded
+type pageCursor struct {
+	Listing listing `json:"l"`
+	After   string  `json:"a,omitempty"`
+	// Set instead of After when going back to a previous page
+	Before string `json:"b,omitempty"`
+	// The number of posts before the page, Reddit uses this to number the posts it sends
+	Count int `json:"c,omitempty"`
+	// How a merged timeline is ranked and where each of its subreddits is up to
+	Rank    string         `json:"k,omitempty"`
+	Sources []sourceCursor `json:"src,omitempty"`
+	// The dedupe session holding the posts the client has already seen
+	Session string `json:"s,omitempty"`
+	// The core user the cursor was made for so it can't be replayed against another user's listing
+	UserID string `json:"u,omitempty"`
+	Issued int64  `json:"i"`
+}
+
+// Signs and verifies cursors so clients can't hand us arbitrary listing state
+type cursorSigner struct {
+	key []byte
+}
+
+// Creates a signer using the given secret. Without a secret a random key is used, which means
+// cursors stop working whenever we restart
+func newCursorSigner(secret string) (*cursorSigner, error) {
+	if secret != "" {
+		return &cursorSigner{key: []byte(secret)}, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &cursorSigner{key: key}, nil
+}
+
+func (c *cursorSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encodes the cursor into an opaque token
+func (c *cursorSigner) Encode(cursor pageCursor) (string, error) {
+	cursor.Issued = time.Now().Unix()
+	contents, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(contents)
+	return payload + "." + c.sign(payload), nil
+}
+
+// Decodes a token made by Encode, the token must have been made for the given user and not have expired
+func (c *cursorSigner) Decode(token, userID string) (*pageCursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(c.sign(parts[0]))) {
+		return nil, errInvalidCursor
+	}
+
+	contents, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	cursor := &pageCursor{}
+	if err := json.Unmarshal(contents, cursor); err != nil {
+		return nil, errInvalidCursor
+	}
+
+	issued := time.Unix(cursor.Issued, 0)
+	if cursor.UserID != userID || time.Since(issued) > cursorTTL || issued.After(time.Now().Add(time.Minute)) {
+		return nil, errInvalidCursor
+	}
+	return cursor, nil
+}
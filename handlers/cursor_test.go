@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func (s *HandlersTestSuite) TestCursorSigner() {
+	signer, err := newCursorSigner("secret")
+	s.Nil(err)
+
+	cursor := pageCursor{Listing: listing{Type: listingSubreddit, Subreddit: "golang", Sort: "top", Time: "week"}, After: "t3_abc", Count: 25, UserID: "user"}
+	token, err := signer.Encode(cursor)
+	s.Nil(err)
+
+	decoded, err := signer.Decode(token, "user")
+	s.Nil(err)
+	s.Equal(cursor.Listing, decoded.Listing)
+	s.Equal("t3_abc", decoded.After)
+	s.Equal(25, decoded.Count)
+
+	// Cursors are only valid for the user they were made for
+	_, err = signer.Decode(token, "someone-else")
+	s.Equal(errInvalidCursor, err)
+
+	// Anything that has been tampered with or signed with another key must be rejected
+	_, err = signer.Decode("t3_abc", "user")
+	s.Equal(errInvalidCursor, err)
+	_, err = signer.Decode(strings.Replace(token, token[:4], "AAAA", 1), "user")
+	s.Equal(errInvalidCursor, err)
+	other, _ := newCursorSigner("other")
+	_, err = other.Decode(token, "user")
+	s.Equal(errInvalidCursor, err)
+}
+
+func (s *HandlersTestSuite) TestCursorExpired() {
+	signer, _ := newCursorSigner("secret")
+
+	contents, _ := json.Marshal(pageCursor{After: "t3_abc", Issued: time.Now().Add(-cursorTTL - time.Minute).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(contents)
+	_, err := signer.Decode(payload+"."+signer.sign(payload), "")
+	s.Equal(errInvalidCursor, err)
+}
+
+func (s *HandlersTestSuite) TestGetPostsCursor() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?subreddit=golang&sort=new&width=320", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("/r/golang/new", s.lastListing.Path)
+
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 20)
+
+	// The next url should be opaque but keep our other options
+	next, err := url.Parse(resp.NextURL)
+	s.Nil(err)
+	s.Equal("/v1/user/posts", next.Path)
+	s.Equal("320", next.Query().Get("width"))
+	s.Empty(next.Query().Get("subreddit"))
+	s.NotContains(next.RawQuery, "t3_p19")
+
+	// The second page should come from the same listing without the posts we have already seen
+	w = s.serveAPI(http.MethodGet, next.RequestURI(), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("/r/golang/new", s.lastListing.Path)
+	s.Equal("t3_p19", s.lastListing.Query().Get("after"))
+	s.Equal("20", s.lastListing.Query().Get("count"))
+
+	resp = ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 15)
+	s.Equal("p20", resp.Posts[0].ID)
+	s.NotEmpty(resp.NextURL)
+	s.NotEmpty(resp.PrevURL)
+
+	// Cursors can't be made up or used by another user
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?continue=t3_p19", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	w = s.serveAPI(http.MethodGet, strings.Replace(next.RequestURI(), "/user/", "/other/", 1), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetListing() {
+	l, err := getListing(url.Values{})
+	s.Nil(err)
+	s.Equal("/", l.path())
+
+	l, err = getListing(url.Values{"subreddit": {"r/golang+rust"}, "sort": {"top"}, "t": {"week"}})
+	s.Nil(err)
+	s.Equal("/r/golang+rust/top", l.path())
+	s.Equal("?t=week", l.query("", "", 0, 0))
+
+	for _, query := range []url.Values{
+		{"subreddit": {"../api"}},
+		{"sort": {"random"}},
+		{"sort": {"new"}, "t": {"week"}},
+		{"sort": {"top"}, "t": {"decade"}},
+	} {
+		_, err := getListing(query)
+		s.NotNil(err, query.Encode())
+	}
+}
+
+func (s *HandlersTestSuite) TestGetPostsLimit() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?limit=5", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("5", s.lastListing.Query().Get("limit"))
+
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 5)
+	s.NotEmpty(resp.NextURL)
+	// There is nothing before the first page
+	s.Empty(resp.PrevURL)
+
+	for _, limit := range []string{"0", "101", "many"} {
+		w := s.serveAPI(http.MethodGet, "/v1/user/posts?limit="+limit, `{"bearer-token": "bearer"}`)
+		s.Equal(http.StatusBadRequest, w.Code)
+	}
+}
+
+func (s *HandlersTestSuite) TestGetPostsBefore() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?before=t3_p30&count=30&limit=10", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("t3_p30", s.lastListing.Query().Get("before"))
+	s.Equal("31", s.lastListing.Query().Get("count"))
+
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 10)
+	s.Equal("p20", resp.Posts[0].ID)
+	s.NotEmpty(resp.NextURL)
+	s.NotEmpty(resp.PrevURL)
+
+	// Going back again should continue from the first post we were sent
+	prev, err := url.Parse(resp.PrevURL)
+	s.Nil(err)
+	s.Empty(prev.Query().Get("before"))
+	w = s.serveAPI(http.MethodGet, prev.RequestURI(), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("t3_p20", s.lastListing.Query().Get("before"))
+	s.Equal("21", s.lastListing.Query().Get("count"))
+
+	resp = ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 10)
+	s.Equal("p10", resp.Posts[0].ID)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?before=p30", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetPopular() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/popular?geo_filter=us_wa&sort=top&t=day&limit=5", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("/r/popular/top", s.lastListing.Path)
+	s.Equal("US_WA", s.lastListing.Query().Get("geo_filter"))
+
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 5)
+
+	// The region should be carried by the cursor rather than the next url
+	next, err := url.Parse(resp.NextURL)
+	s.Nil(err)
+	s.Equal("/v1/user/popular", next.Path)
+	s.Empty(next.Query().Get("geo_filter"))
+	cursor, err := s.handler.cursors.Decode(next.Query().Get("continue"), "user")
+	s.Nil(err)
+	s.Equal(listing{Type: listingPopular, Sort: "top", Time: "day", Geo: "US_WA"}, cursor.Listing)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/popular?geo_filter=narnia", "")
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestCursorWrongEndpoint() {
+	// Each endpoint only accepts cursors for the listings it serves itself
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?subreddit=golang&sort=new&limit=5", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	next, err := url.Parse(resp.NextURL)
+	s.Nil(err)
+	subredditToken := url.QueryEscape(next.Query().Get("continue"))
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/popular?continue="+subredditToken, `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	w = s.serveAPI(http.MethodGet, "/v1/user/all?continue="+subredditToken, `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?continue="+subredditToken, `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/popular?sort=new&limit=5", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	resp = ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	next, err = url.Parse(resp.NextURL)
+	s.Nil(err)
+	popularToken := url.QueryEscape(next.Query().Get("continue"))
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?continue="+popularToken, `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	w = s.serveAPI(http.MethodGet, "/v1/user/all?continue="+popularToken, `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestPopularListing() {
+	l, err := getPopularListing(url.Values{"geo_filter": {"GB"}, "sort": {"new"}})
+	s.Nil(err)
+	s.Equal("/r/popular/new", l.path())
+	s.Equal("?geo_filter=GB&limit=10", l.query("", "", 0, 10))
+
+	l, err = getAllListing(url.Values{"sort": {"rising"}})
+	s.Nil(err)
+	s.Equal("/r/all/rising", l.path())
+
+	_, err = getAllListing(url.Values{"sort": {"hot"}, "t": {"week"}})
+	s.NotNil(err)
+}
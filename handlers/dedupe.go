@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"strings"
+)
+
+const (
+	// Sessions last as long as the cursors that point at them
+	sessionTTL = cursorTTL
+	// Every page makes a new session so the least recently used are dropped once we hold this many
+	maxSessions = 2000
+	// Listings shift by a few posts at most so we only need to remember the most recent ones
+	maxSessionPosts = 1000
+)
+
+// Another post linking to the same page that was collapsed into this one
+type RepostRef struct {
+	ID        string `json:"id"`
+	Subreddit string `json:"subreddit"`
+	PostLink  string `json:"postLink"`
+	Score     int    `json:"score"`
+}
+
+// What a client has already been sent during a pagination session. Snapshots are never modified
+// once stored so a retried page is deduped against exactly the same posts as the first attempt
+type seenPosts struct {
+	IDs     []string
+	URLKeys []string
+}
+
+// Tracks the posts seen while building a single page
+type pageDeduper struct {
+	ids        map[string]bool
+	urlKeys    map[string]bool
+	newIDs     []string
+	newURLKeys []string
+	previous   seenPosts
+}
+
+func newPageDeduper(previous seenPosts) *pageDeduper {
+	d := &pageDeduper{ids: map[string]bool{}, urlKeys: map[string]bool{}, previous: previous}
+	for _, id := range previous.IDs {
+		d.ids[id] = true
+	}
+	for _, key := range previous.URLKeys {
+		d.urlKeys[key] = true
+	}
+	return d
+}
+
+// Whether the post has already been sent, marks it as seen if it hasn't
+func (d *pageDeduper) seenID(id string) bool {
+	if d.ids[id] {
+		return true
+	}
+	d.ids[id] = true
+	d.newIDs = append(d.newIDs, id)
+	return false
+}
+
+// Whether a post linking to the same page was sent on an earlier page
+func (d *pageDeduper) seenURL(key string) bool {
+	if d.urlKeys[key] {
+		return true
+	}
+	d.urlKeys[key] = true
+	d.newURLKeys = append(d.newURLKeys, key)
+	return false
+}
+
+// Keeps only the most recent keys so sessions can't grow forever
+func appendRecent(keys []string, added []string) []string {
+	all := append(append([]string{}, keys...), added...)
+	if len(all) > maxSessionPosts {
+		all = all[len(all)-maxSessionPosts:]
+	}
+	return all
+}
+
+// Builds the snapshot to hand to the next page
+func (d *pageDeduper) snapshot() seenPosts {
+	return seenPosts{
+		IDs:     appendRecent(d.previous.IDs, d.newIDs),
+		URLKeys: appendRecent(d.previous.URLKeys, d.newURLKeys),
+	}
+}
+
+// Gets the key used to collapse reposts. Reddit sends crossposts of self posts with a relative url
+// so we resolve those against reddit to match the original
+func getRepostKey(post RedditPost) string {
+	link := post.URL
+	if strings.HasPrefix(link, "/") {
+		link = redditBaseURL + link
+	}
+	return getURLKey(link)
+}
+
+// Gets what the client has seen so far in the session. Sessions we have dropped start fresh, in which case
+// false is returned as posts from earlier pages may be sent again
+func (api *CoreHandler) getSeenPosts(session string) (seenPosts, bool) {
+	if session == "" {
+		return seenPosts{}, true
+	}
+	if seen, ok := api.sessions.Get(session); ok {
+		return seen.(seenPosts), true
+	}
+	return seenPosts{}, false
+}
+
+// Stores the snapshot under a new session id, returns an empty id if one couldn't be made
+func (api *CoreHandler) saveSeenPosts(seen seenPosts) string {
+	session, err := newRandomID()
+	if err != nil {
+		return ""
+	}
+	api.sessions.Set(session, seen)
+	return session
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (s *HandlersTestSuite) TestPageDeduper() {
+	first := newPageDeduper(seenPosts{})
+	s.False(first.seenID("a"))
+	s.False(first.seenID("b"))
+	s.True(first.seenID("a"))
+	s.False(first.seenURL("example.com/a"))
+	s.True(first.seenURL("example.com/a"))
+
+	session := s.handler.saveSeenPosts(first.snapshot())
+	s.NotEmpty(session)
+
+	// The next page should skip everything sent on the first
+	seen, ok := s.handler.getSeenPosts(session)
+	s.True(ok)
+	second := newPageDeduper(seen)
+	s.True(second.seenID("b"))
+	s.True(second.seenURL("example.com/a"))
+	s.False(second.seenID("c"))
+
+	// Retrying the same page must give the same answer as the stored snapshot is never changed
+	seen, _ = s.handler.getSeenPosts(session)
+	retry := newPageDeduper(seen)
+	s.False(retry.seenID("c"))
+
+	// Unknown sessions start from nothing and are reported as gone
+	seen, ok = s.handler.getSeenPosts("unknown")
+	s.False(ok)
+	s.Equal(seenPosts{}, seen)
+}
+
+func (s *HandlersTestSuite) TestLRUCache() {
+	c := newLRUCache(time.Hour, 2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// Using a makes b the least recently used so it is the one dropped
+	_, ok := c.Get("a")
+	s.True(ok)
+	c.Set("c", 3)
+	_, ok = c.Get("b")
+	s.False(ok)
+	value, ok := c.Get("a")
+	s.True(ok)
+	s.Equal(1, value)
+
+	expired := newLRUCache(-time.Second, 2)
+	expired.Set("a", 1)
+	_, ok = expired.Get("a")
+	s.False(ok)
+	s.Equal(0, expired.order.Len())
+}
+
+func (s *HandlersTestSuite) TestPageDeduperLimit() {
+	d := newPageDeduper(seenPosts{})
+	for i := 0; i < maxSessionPosts+10; i++ {
+		d.seenID(fmt.Sprintf("post%v", i))
+	}
+
+	seen := d.snapshot()
+	s.Len(seen.IDs, maxSessionPosts)
+	s.Equal("post10", seen.IDs[0])
+}
+
+func (s *HandlersTestSuite) TestGetRepostKey() {
+	link := RedditPost{URL: "https://www.example.com/story?utm_source=reddit"}
+	crosspost := RedditPost{URL: "https://example.com/story"}
+	s.Equal(getRepostKey(link), getRepostKey(crosspost))
+
+	self := RedditPost{URL: "https://www.reddit.com/r/golang/comments/abc/title/"}
+	selfCrosspost := RedditPost{URL: "/r/golang/comments/abc/title/"}
+	s.Equal(getRepostKey(self), getRepostKey(selfCrosspost))
+}
+
+func (s *HandlersTestSuite) TestGetPostsSessionExpired() {
+	token, err := s.handler.cursors.Encode(pageCursor{Listing: listing{Type: listingFront}, After: "t3_p19", Count: 20, Session: "forgotten", UserID: "user"})
+	s.Nil(err)
+
+	// Clients should be told when a page may repeat posts because we have dropped their session
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?continue="+url.QueryEscape(token), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.True(resp.SessionExpired)
+
+	// First pages have no session to lose
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts", `{"bearer-token": "bearer"}`)
+	resp = ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.False(resp.SessionExpired)
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// Permissions given to embedded players, they need scripts but must never be able to navigate our frontend
+	embedSandbox = "allow-scripts allow-same-origin allow-popups allow-presentation"
+	embedAllow   = "autoplay; encrypted-media; fullscreen; picture-in-picture"
+)
+
+// Hosts we allow iframes to point at and the provider they belong to
+var embedProviders = map[string]string{
+	"www.youtube.com":          "YouTube",
+	"youtube.com":              "YouTube",
+	"www.youtube-nocookie.com": "YouTube",
+	"player.vimeo.com":         "Vimeo",
+	"streamable.com":           "Streamable",
+	"gfycat.com":               "Gfycat",
+	"www.redgifs.com":          "RedGIFs",
+	"platform.twitter.com":     "Twitter",
+	"clips.twitch.tv":          "Twitch",
+	"player.twitch.tv":         "Twitch",
+	"w.soundcloud.com":         "SoundCloud",
+	"open.spotify.com":         "Spotify",
+	"imgur.com":                "Imgur",
+}
+
+var tweetPattern = regexp.MustCompile(`^/[^/]+/status(?:es)?/(\d+)`)
+
+// Struct for the oembed data Reddit fetches for links to embeddable sites
+type RedditOEmbed struct {
+	ProviderName    string `json:"provider_name"`
+	Title           string `json:"title"`
+	Type            string `json:"type"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+// Struct for a posts media_embed and secure_media_embed
+type RedditMediaEmbed struct {
+	Content string `json:"content"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+// A third party player that is safe for clients to render inline
+type Embed struct {
+	Provider  string `json:"provider"`
+	Title     string `json:"title,omitempty"`
+	EmbedURL  string `json:"embedURL"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// An iframe we built ourselves from the embed url, none of Reddit's html is passed through
+	HTML string `json:"html"`
+}
+
+// Finds the src of the first iframe in the given html
+func getIframeSource(content string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(html.UnescapeString(content)), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "div",
+		DataAtom: atom.Div,
+	})
+	if err != nil {
+		return ""
+	}
+
+	var find func(n *html.Node) string
+	find = func(n *html.Node) string {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Iframe {
+			for _, a := range n.Attr {
+				if strings.ToLower(a.Key) == "src" {
+					return a.Val
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if src := find(c); src != "" {
+				return src
+			}
+		}
+		return ""
+	}
+
+	for _, n := range nodes {
+		if src := find(n); src != "" {
+			return src
+		}
+	}
+	return ""
+}
+
+// Checks the embed url points at a provider we trust and returns it along with the provider's name
+func getEmbedURL(raw string) (string, string, bool) {
+	if strings.HasPrefix(raw, "//") {
+		raw = "https:" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", "", false
+	}
+
+	provider, ok := embedProviders[strings.ToLower(u.Hostname())]
+	if !ok {
+		return "", "", false
+	}
+	u.Scheme = "https"
+	return u.String(), provider, true
+}
+
+// Twitter's oembed is a blockquote and a script rather than an iframe, so we point at their iframe player instead
+func getTweetEmbedURL(link string) string {
+	u, err := url.Parse(html.UnescapeString(link))
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "mobile.")
+	if host != "twitter.com" && host != "x.com" {
+		return ""
+	}
+	m := tweetPattern.FindStringSubmatch(u.Path)
+	if m == nil {
+		return ""
+	}
+	return "https://platform.twitter.com/embed/Tweet.html?id=" + m[1]
+}
+
+// Renders a sandboxed iframe for the given embed
+func renderEmbedHTML(embed *Embed) string {
+	iframe := &html.Node{Type: html.ElementNode, Data: "iframe", DataAtom: atom.Iframe, Attr: []html.Attribute{
+		{Key: "src", Val: embed.EmbedURL},
+		{Key: "sandbox", Val: embedSandbox},
+		{Key: "allow", Val: embedAllow},
+		{Key: "allowfullscreen"},
+		{Key: "frameborder", Val: "0"},
+		{Key: "scrolling", Val: "no"},
+	}}
+	if embed.Width > 0 && embed.Height > 0 {
+		iframe.Attr = append(iframe.Attr,
+			html.Attribute{Key: "width", Val: strconv.Itoa(embed.Width)},
+			html.Attribute{Key: "height", Val: strconv.Itoa(embed.Height)})
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, iframe); err != nil {
+		log.Printf("Unable to render embed: %v", err)
+		return ""
+	}
+	return buf.String()
+}
+
+// Gets a safe embed for the post, preferring the secure versions of Reddit's embed data.
+// Returns nil if the post has nothing we can embed from a trusted provider
+func getEmbed(post RedditPost) *Embed {
+	var oembed *RedditOEmbed
+	for _, media := range []*RedditMedia{post.SecureMedia, post.Media} {
+		if media != nil && media.OEmbed != nil {
+			oembed = media.OEmbed
+			break
+		}
+	}
+
+	candidates := []RedditMediaEmbed{}
+	if oembed != nil {
+		candidates = append(candidates, RedditMediaEmbed{Content: oembed.HTML, Width: oembed.Width, Height: oembed.Height})
+	}
+	candidates = append(candidates, post.SecureMediaEmbed, post.MediaEmbed)
+
+	embed := &Embed{}
+	for _, c := range candidates {
+		if src := getIframeSource(c.Content); src != "" {
+			if embedURL, provider, ok := getEmbedURL(src); ok {
+				embed.EmbedURL, embed.Provider = embedURL, provider
+				embed.Width, embed.Height = c.Width, c.Height
+				break
+			}
+		}
+	}
+
+	if embed.EmbedURL == "" && oembed != nil {
+		if embedURL := getTweetEmbedURL(post.URL); embedURL != "" {
+			embed.EmbedURL, embed.Provider = embedURL, "Twitter"
+		}
+	}
+	if embed.EmbedURL == "" {
+		return nil
+	}
+
+	if oembed != nil {
+		embed.Title = html.UnescapeString(oembed.Title)
+		embed.Thumbnail = getThumbnail(oembed.ThumbnailURL)
+		if embed.Width == 0 || embed.Height == 0 {
+			embed.Width, embed.Height = oembed.Width, oembed.Height
+		}
+	}
+	embed.HTML = renderEmbedHTML(embed)
+	return embed
+}
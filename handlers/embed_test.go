@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+)
+
+const youtubePost = `{
+	"url": "https://www.youtube.com/watch?v=abc",
+	"secure_media": {"type": "youtube.com", "oembed": {
+		"provider_name": "YouTube",
+		"title": "Cats &amp; dogs",
+		"html": "&lt;iframe width=\"356\" height=\"200\" src=\"https://www.youtube.com/embed/abc?feature=oembed&amp;enablejsapi=1\" onload=\"alert(1)\"&gt;&lt;/iframe&gt;",
+		"width": 356,
+		"height": 200,
+		"thumbnail_url": "https://i.ytimg.com/vi/abc/hqdefault.jpg"
+	}},
+	"secure_media_embed": {"content": "&lt;iframe src=\"https://evil.example.com/\"&gt;&lt;/iframe&gt;", "width": 356, "height": 200}
+}`
+
+func (s *HandlersTestSuite) TestGetEmbed() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(youtubePost), &post))
+
+	embed := getEmbed(post)
+	s.NotNil(embed)
+	s.Equal("YouTube", embed.Provider)
+	s.Equal("Cats & dogs", embed.Title)
+	s.Equal("https://www.youtube.com/embed/abc?feature=oembed&enablejsapi=1", embed.EmbedURL)
+	s.Equal(356, embed.Width)
+	s.Equal(200, embed.Height)
+	s.Equal("https://i.ytimg.com/vi/abc/hqdefault.jpg", embed.Thumbnail)
+
+	// We only ever send our own iframe, nothing from Reddit's html should survive
+	s.Contains(embed.HTML, `src="https://www.youtube.com/embed/abc?feature=oembed&amp;enablejsapi=1"`)
+	s.Contains(embed.HTML, `sandbox="`+embedSandbox+`"`)
+	s.NotContains(embed.HTML, "onload")
+}
+
+func (s *HandlersTestSuite) TestGetEmbedUntrustedProvider() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"secure_media_embed": {"content": "&lt;iframe src=\"javascript:alert(1)\"&gt;&lt;/iframe&gt;"},
+		"media_embed": {"content": "&lt;iframe src=\"https://evil.example.com/player\"&gt;&lt;/iframe&gt;"}
+	}`), &post))
+	s.Nil(getEmbed(post))
+}
+
+func (s *HandlersTestSuite) TestGetEmbedTweet() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"url": "https://twitter.com/golang/status/12345",
+		"secure_media": {"type": "twitter.com", "oembed": {
+			"provider_name": "Twitter",
+			"html": "&lt;blockquote class=\"twitter-tweet\"&gt;Hello&lt;/blockquote&gt;&lt;script src=\"https://platform.twitter.com/widgets.js\"&gt;&lt;/script&gt;"
+		}}
+	}`), &post))
+
+	embed := getEmbed(post)
+	s.NotNil(embed)
+	s.Equal("Twitter", embed.Provider)
+	s.Equal("https://platform.twitter.com/embed/Tweet.html?id=12345", embed.EmbedURL)
+	s.NotContains(embed.HTML, "<script")
+}
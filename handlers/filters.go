@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+const (
+	prefsEndpoint = "/api/v1/me/prefs"
+
+	filterHide = "hide"
+	filterBlur = "blur"
+	filterShow = "show"
+
+	// How long we trust a users Reddit preferences before fetching them again
+	prefsTTL = time.Hour
+)
+
+var filterValues = map[string]bool{filterHide: true, filterBlur: true, filterShow: true}
+
+// Controls how sensitive content is handled, empty values mean the setting hasn't been chosen
+type FilterSettings struct {
+	// One of hide, blur or show
+	NSFW     string `json:"nsfw,omitempty"`
+	Spoilers string `json:"spoilers,omitempty"`
+	// Either hide or show, quarantined subreddits are hidden unless the user opts in
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// The subset of /api/v1/me/prefs that we care about
+type RedditPrefs struct {
+	Over18 bool `json:"over_18"`
+}
+
+// Defaults used when neither the request, the user or Reddit tell us otherwise
+var defaultFilters = FilterSettings{NSFW: filterBlur, Spoilers: filterBlur, Quarantine: filterHide}
+
+func (f FilterSettings) validate() error {
+	if f.NSFW != "" && !filterValues[f.NSFW] {
+		return fmt.Errorf("nsfw must be one of hide, blur or show")
+	}
+	if f.Spoilers != "" && !filterValues[f.Spoilers] {
+		return fmt.Errorf("spoilers must be one of hide, blur or show")
+	}
+	if f.Quarantine != "" && f.Quarantine != filterHide && f.Quarantine != filterShow {
+		return fmt.Errorf("quarantine must be either hide or show")
+	}
+	return nil
+}
+
+// Fills in any settings that haven't been chosen using the given fallback
+func (f FilterSettings) withDefaults(fallback FilterSettings) FilterSettings {
+	if f.NSFW == "" {
+		f.NSFW = fallback.NSFW
+	}
+	if f.Spoilers == "" {
+		f.Spoilers = fallback.Spoilers
+	}
+	if f.Quarantine == "" {
+		f.Quarantine = fallback.Quarantine
+	}
+	return f
+}
+
+func getFilterSettings(queryParams url.Values) (FilterSettings, error) {
+	filters := FilterSettings{
+		NSFW:       queryParams.Get("nsfw"),
+		Spoilers:   queryParams.Get("spoilers"),
+		Quarantine: queryParams.Get("quarantine"),
+	}
+	return filters, filters.validate()
+}
+
+// Gets the users Reddit preferences, these are cached as they rarely change
+func (api *CoreHandler) getRedditPrefs(auth *AuthRequest, userID string) (*RedditPrefs, error) {
+	if prefs, ok := api.prefs.Get(userID); ok {
+		return prefs.(*RedditPrefs), nil
+	}
+
+	req, err := api.newRedditRequest(http.MethodGet, prefsEndpoint, auth.BearerToken, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := api.completeRequest(auth, userID, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Did not receive 200 OK when trying to get prefs from reddit. Received: %v", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := &RedditPrefs{}
+	if err := json.Unmarshal(body, prefs); err != nil {
+		log.Printf("Unable to unmarshall response: %v\n", err)
+		return nil, err
+	}
+
+	api.prefs.Set(userID, prefs)
+	return prefs, nil
+}
+
+// Resolves the filters to use for a request. Settings in the request win, then the users saved
+// settings and finally their Reddit over_18 preference
+func (api *CoreHandler) resolveFilters(requested FilterSettings, userID string, auth *AuthRequest) FilterSettings {
+	if userID == "" {
+		return requested.withDefaults(defaultFilters)
+	}
+
+	filters := requested.withDefaults(api.store.Get(userID).Filters)
+	if filters.NSFW == "" && auth.BearerToken != "" {
+		prefs, err := api.getRedditPrefs(auth, userID)
+		if err != nil {
+			log.Printf("Unable to get reddit prefs for user %v: %v", userID, err)
+		} else if prefs.Over18 {
+			filters.NSFW = filterShow
+		} else {
+			filters.NSFW = filterHide
+		}
+	}
+
+	return filters.withDefaults(defaultFilters)
+}
+
+// Returns how the given post should be treated, posts are only shown as is when every filter allows it
+func (f FilterSettings) apply(post RedditPost) string {
+	if post.Quarantine && f.Quarantine != filterShow {
+		return filterHide
+	}
+
+	action := filterShow
+	for _, filter := range []struct {
+		applies bool
+		setting string
+	}{{post.Over18, f.NSFW}, {post.Spoiler, f.Spoilers}} {
+		if !filter.applies || filter.setting == filterShow {
+			continue
+		}
+		if filter.setting == filterHide {
+			return filterHide
+		}
+		action = filterBlur
+	}
+	return action
+}
+
+// Gets the obfuscated version of an image that Reddit provides for NSFW and spoiler posts
+func getObfuscatedVariant(image RedditImage, nsfw bool) ImageVariant {
+	if nsfw && image.Variants.NSFW.Source != nil {
+		return image.Variants.NSFW
+	}
+	return image.Variants.Obfuscated
+}
+
+// Gets the best blurred image and every blurred resolution, nothing is returned if Reddit hasn't sent a blurred version
+func getBlurredImage(image RedditImage, nsfw bool, targetWidth int) (string, *ImageSet) {
+	variant := getObfuscatedVariant(image, nsfw)
+	sources := append(variant.Resolutions, variant.Source)
+
+	resolutions := getResolutions(sources)
+	if len(resolutions) == 0 {
+		return "", nil
+	}
+	return html.UnescapeString(getBestResolution(sources, targetWidth)), &ImageSet{Static: resolutions}
+}
+
+// Gets the filter settings saved for the user
+// GET /v1/{id}/settings/filters
+func (api *CoreHandler) GetFilterSettings(w http.ResponseWriter, r *http.Request) {
+	filters := api.store.Get(mux.Vars(r)["id"]).Filters
+
+	res, err := json.Marshal(filters)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Replaces the filter settings saved for the user, settings left empty fall back to the defaults
+// PUT /v1/{id}/settings/filters
+func (api *CoreHandler) UpdateFilterSettings(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filters := FilterSettings{}
+	if err := json.Unmarshal(body, &filters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := filters.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = api.store.Update(mux.Vars(r)["id"], func(data *UserData) {
+		data.Filters = filters
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *HandlersTestSuite) TestFilterApply() {
+	nsfw := RedditPost{Over18: true}
+	spoiler := RedditPost{Spoiler: true}
+	quarantined := RedditPost{Quarantine: true}
+
+	filters := FilterSettings{NSFW: filterHide, Spoilers: filterBlur, Quarantine: filterHide}
+	s.Equal(filterHide, filters.apply(nsfw))
+	s.Equal(filterBlur, filters.apply(spoiler))
+	s.Equal(filterHide, filters.apply(quarantined))
+	s.Equal(filterShow, filters.apply(RedditPost{}))
+
+	// The strictest filter that applies should win
+	s.Equal(filterHide, filters.apply(RedditPost{Over18: true, Spoiler: true}))
+
+	filters = FilterSettings{NSFW: filterShow, Spoilers: filterShow, Quarantine: filterShow}
+	s.Equal(filterShow, filters.apply(nsfw))
+	s.Equal(filterShow, filters.apply(quarantined))
+}
+
+func (s *HandlersTestSuite) TestResolveFilters() {
+	// Anonymous requests use our defaults
+	filters := s.handler.resolveFilters(FilterSettings{Spoilers: filterShow}, "", &AuthRequest{})
+	s.Equal(FilterSettings{NSFW: filterBlur, Spoilers: filterShow, Quarantine: filterHide}, filters)
+
+	// Users that haven't chosen should get their reddit over_18 preference
+	filters = s.handler.resolveFilters(FilterSettings{}, "prefsuser", &AuthRequest{BearerToken: "bearer"})
+	s.Equal(filterShow, filters.NSFW)
+
+	// Saved settings win over reddit, and the request wins over both
+	s.Nil(s.handler.store.Update("saveduser", func(data *UserData) {
+		data.Filters = FilterSettings{NSFW: filterHide, Quarantine: filterShow}
+	}))
+	filters = s.handler.resolveFilters(FilterSettings{}, "saveduser", &AuthRequest{BearerToken: "bearer"})
+	s.Equal(FilterSettings{NSFW: filterHide, Spoilers: filterBlur, Quarantine: filterShow}, filters)
+	filters = s.handler.resolveFilters(FilterSettings{NSFW: filterBlur}, "saveduser", &AuthRequest{BearerToken: "bearer"})
+	s.Equal(filterBlur, filters.NSFW)
+}
+
+func (s *HandlersTestSuite) TestGetBlurredImage() {
+	image := RedditImage{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"source": {"url": "https://i.redd.it/real.jpg", "width": 1000},
+		"variants": {
+			"obfuscated": {"source": {"url": "https://i.redd.it/spoiler.jpg?blur=40&amp;s=1", "width": 1000}},
+			"nsfw": {"source": {"url": "https://i.redd.it/nsfw.jpg", "width": 1000}}
+		}
+	}`), &image))
+
+	heroImg, images := getBlurredImage(image, true, targetImageWidth)
+	s.Equal("https://i.redd.it/nsfw.jpg", heroImg)
+	s.Len(images.Static, 1)
+
+	heroImg, _ = getBlurredImage(image, false, targetImageWidth)
+	s.Equal("https://i.redd.it/spoiler.jpg?blur=40&s=1", heroImg)
+
+	// The real image should never be used as a fallback
+	heroImg, images = getBlurredImage(RedditImage{Source: image.Source}, true, targetImageWidth)
+	s.Equal("", heroImg)
+	s.Nil(images)
+}
+
+func (s *HandlersTestSuite) TestFilterSettingsEndpoints() {
+	w := s.serveAPI(http.MethodPut, "/v1/filteruser/settings/filters", `{"nsfw": "show", "spoilers": "hide"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.serveAPI(http.MethodGet, "/v1/filteruser/settings/filters", "")
+	s.Equal(http.StatusOK, w.Code)
+	s.JSONEq(`{"nsfw": "show", "spoilers": "hide"}`, w.Body.String())
+
+	w = s.serveAPI(http.MethodPut, "/v1/filteruser/settings/filters", `{"nsfw": "sometimes"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestNewPostBlurred() {
+	spoiler := RedditPost{Title: "Ending", Spoiler: true, IsSelf: true, Content: selfPostHTML, SelfText: "The butler did it"}
+
+	// Blurred posts shouldn't send the text they are hiding
+	post, ok := newPost(spoiler, &postOptions{targetWidth: targetImageWidth, contentFormat: contentFormatText, excerptLength: 10, filters: FilterSettings{Spoilers: filterBlur}})
+	s.True(ok)
+	s.True(post.Blurred)
+	s.Equal("Ending", post.Title)
+	s.Empty(post.Content)
+	s.Empty(post.Excerpt)
+
+	post, ok = newPost(spoiler, &postOptions{targetWidth: targetImageWidth, contentFormat: contentFormatText, excerptLength: 10, filters: FilterSettings{Spoilers: filterShow}})
+	s.True(ok)
+	s.False(post.Blurred)
+	s.NotEmpty(post.Content)
+	s.NotEmpty(post.Excerpt)
+}
@@ -8,10 +8,15 @@ import (
 	"errors"
 	"fmt"
 	"golang.org/x/net/html"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -28,13 +33,31 @@ const (
 	userAgent           = "web:icedmocha:v0.0.1 (by /u/icedmoch)"
 
 	// These words give us access to specific things in Reddit API - see docs for more info
-	redditAPIScope   = "history identity mysubreddits read"
+	redditAPIScope   = "history identity mysubreddits read vote save report submit"
 	targetImageWidth = 600
+	maxImageWidth    = 4096
+
+	// We fetch more pages from reddit when filtering leaves us with fewer posts than this
+	minPageSize     = 15
+	maxListingPages = 3
+	maxListingLimit = 100
+	// The page size Reddit uses when it isn't given a limit
+	defaultListingLimit = 25
 )
 
 type CoreHandler struct {
 	client *http.Client
 	conf   *config.Config
+	store  *userStore
+	// Reddit preferences of our users keyed by their core user id
+	prefs    *ttlCache
+	sessions *lruCache
+	// About pages and rules of subreddits keyed by their lowercased name
+	subreddits *ttlCache
+	cursors    *cursorSigner
+	streams    *streamHub
+	watches    *watchRunner
+	previews   *linkPreviewer
 }
 
 type AuthRequest struct {
@@ -51,9 +74,31 @@ type RedditAuthResponse struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
-// Struct for the response from reddit when GETting the /api/v1/me endpoint
+// Struct for the response from reddit when GETting the /api/v1/me endpoint, /user/{name}/about
+// sends the same account fields for everyone else
 type IdentityResponse struct {
-	RedditUsername string `json:"name"`
+	RedditUsername   string  `json:"name"`
+	ID               string  `json:"id"`
+	IconImg          string  `json:"icon_img"`
+	SnoovatarImg     string  `json:"snoovatar_img"`
+	UnixTime         float64 `json:"created_utc"`
+	LinkKarma        int     `json:"link_karma"`
+	CommentKarma     int     `json:"comment_karma"`
+	AwarderKarma     int     `json:"awarder_karma"`
+	AwardeeKarma     int     `json:"awardee_karma"`
+	TotalKarma       int     `json:"total_karma"`
+	Verified         bool    `json:"verified"`
+	HasVerifiedEmail bool    `json:"has_verified_email"`
+	IsGold           bool    `json:"is_gold"`
+	IsMod            bool    `json:"is_mod"`
+	IsEmployee       bool    `json:"is_employee"`
+	IsSuspended      bool    `json:"is_suspended"`
+	// The user's profile, which Reddit treats as a subreddit
+	Subreddit *struct {
+		PublicDescription string `json:"public_description"`
+		BannerImg         string `json:"banner_img"`
+		Over18            bool   `json:"over_18"`
+	} `json:"subreddit"`
 }
 
 type ImageSource struct {
@@ -62,21 +107,30 @@ type ImageSource struct {
 	Height int    `json:"height"`
 }
 
+type ImageVariant struct {
+	Source      *ImageSource   `json:"source"`
+	Resolutions []*ImageSource `json:"resolutions"`
+}
+
 type RedditImage struct {
 	Source   *ImageSource `json:"source"`
 	Variants struct {
-		GIF struct {
-			Source      *ImageSource   `json:"source"`
-			Resolutions []*ImageSource `json:"resolutions"`
-		} `json:"gif"`
-		MP4 struct {
-			Source      *ImageSource   `json:"source"`
-			Resolutions []*ImageSource `json:"resolutions"`
-		} `json:"mp4"`
+		GIF ImageVariant `json:"gif"`
+		MP4 ImageVariant `json:"mp4"`
+		// Blurred versions of the image for NSFW and spoiler posts
+		NSFW       ImageVariant `json:"nsfw"`
+		Obfuscated ImageVariant `json:"obfuscated"`
 	} `json:"variants"`
 	Resolutions []*ImageSource `json:"resolutions"`
 }
 
+// Every resolution of an image in each of its variants
+type ImageSet struct {
+	Static []ImageSource `json:"static,omitempty"`
+	GIF    []ImageSource `json:"gif,omitempty"`
+	MP4    []ImageSource `json:"mp4,omitempty"`
+}
+
 type RedditPost struct {
 	ID           string `json:"id"`
 	Author       string `json:"author"`
@@ -91,6 +145,44 @@ type RedditPost struct {
 	UnixTime float64 `json:"created_utc"`
 	IsVideo  bool    `json:"is_video"`
 	Content  string  `json:"selftext_html"`
+	SelfText string  `json:"selftext"`
+
+	IsGallery     bool                           `json:"is_gallery"`
+	GalleryData   RedditGalleryData              `json:"gallery_data"`
+	MediaMetadata map[string]RedditMediaMetadata `json:"media_metadata"`
+
+	Media            *RedditMedia     `json:"media"`
+	SecureMedia      *RedditMedia     `json:"secure_media"`
+	MediaEmbed       RedditMediaEmbed `json:"media_embed"`
+	SecureMediaEmbed RedditMediaEmbed `json:"secure_media_embed"`
+
+	NumComments           int               `json:"num_comments"`
+	UpvoteRatio           float64           `json:"upvote_ratio"`
+	Over18                bool              `json:"over_18"`
+	Spoiler               bool              `json:"spoiler"`
+	Stickied              bool              `json:"stickied"`
+	Locked                bool              `json:"locked"`
+	Archived              bool              `json:"archived"`
+	Edited                RedditEdited      `json:"edited"`
+	LinkFlairText         string            `json:"link_flair_text"`
+	LinkFlairRichtext     []RedditFlairPart `json:"link_flair_richtext"`
+	LinkFlairBackground   string            `json:"link_flair_background_color"`
+	LinkFlairTextColor    string            `json:"link_flair_text_color"`
+	AuthorFlairText       string            `json:"author_flair_text"`
+	AuthorFlairRichtext   []RedditFlairPart `json:"author_flair_richtext"`
+	AuthorFlairBackground string            `json:"author_flair_background_color"`
+	AuthorFlairTextColor  string            `json:"author_flair_text_color"`
+	Domain                string            `json:"domain"`
+	Thumbnail             string            `json:"thumbnail"`
+	Distinguished         string            `json:"distinguished"`
+	TotalAwards           int               `json:"total_awards_received"`
+	Quarantine            bool              `json:"quarantine"`
+	IsSelf                bool              `json:"is_self"`
+	PostHint              string            `json:"post_hint"`
+	// Set to moderator, deleted and so on once a post has been taken down
+	RemovedByCategory string `json:"removed_by_category"`
+
+	CrosspostParentList []RedditPost `json:"crosspost_parent_list"`
 }
 
 type RedditResponse struct {
@@ -99,14 +191,63 @@ type RedditResponse struct {
 		Children []struct {
 			Data RedditPost `json:"data"`
 		} `json:"children"`
-		After string `json:"after"`
+		After  string `json:"after"`
+		Before string `json:"before"`
 	} `json:"data"`
 }
 
+// The normalized post we send to clients, this extends the shared post with reddit specific fields
+type Post struct {
+	models.Post
+	// The url exactly as Reddit sent it, URL is normalized
+	OriginalURL string       `json:"originalURL,omitempty"`
+	Excerpt     string       `json:"excerpt,omitempty"`
+	Images      *ImageSet    `json:"images,omitempty"`
+	Gallery     []MediaItem  `json:"gallery,omitempty"`
+	RedditVideo *VideoStream `json:"redditVideo,omitempty"`
+	Embed       *Embed       `json:"embed,omitempty"`
+
+	NumComments   int        `json:"numComments"`
+	UpvoteRatio   float64    `json:"upvoteRatio"`
+	NSFW          bool       `json:"nsfw"`
+	Spoiler       bool       `json:"spoiler"`
+	Stickied      bool       `json:"stickied"`
+	Locked        bool       `json:"locked"`
+	Archived      bool       `json:"archived"`
+	Edited        *time.Time `json:"edited,omitempty"`
+	LinkFlair     *Flair     `json:"linkFlair,omitempty"`
+	AuthorFlair   *Flair     `json:"authorFlair,omitempty"`
+	Domain        string     `json:"domain,omitempty"`
+	Thumbnail     string     `json:"thumbnail,omitempty"`
+	Distinguished string     `json:"distinguished,omitempty"`
+	TotalAwards   int        `json:"totalAwards"`
+	// Whether the media has been replaced with blurred versions because of the users filters, the text of
+	// blurred posts is held back
+	Blurred         bool          `json:"blurred"`
+	CrosspostedFrom *CrosspostRef `json:"crosspostedFrom,omitempty"`
+	LinkPreview     *LinkPreview  `json:"linkPreview,omitempty"`
+	Reposts         []RepostRef   `json:"reposts,omitempty"`
+	// One of self, image, gallery, video, gif, link or embed
+	MediaType string `json:"mediaType"`
+	MediaURL  string `json:"mediaURL,omitempty"`
+}
+
+type ClientResp struct {
+	Posts   []Post `json:"posts"`
+	NextURL string `json:"nextURL"`
+	PrevURL string `json:"prevURL"`
+	// Set when we no longer know what earlier pages sent so this page may repeat some of their posts
+	SessionExpired bool `json:"sessionExpired,omitempty"`
+}
+
 func New(conf *config.Config) (*CoreHandler, error) {
 	if conf == nil {
 		return nil, errors.New("must initialize handler with non-nil config")
 	}
+	// Core can't tell our deliveries apart from anyone else's unless they are signed
+	if len(conf.WebhookURLs) > 0 && conf.WebhookSecret == "" {
+		return nil, errors.New("a webhook secret is required when webhook urls are configured")
+	}
 
 	caCert, err := ioutil.ReadFile("/usr/local/etc/ssl/certs/core.crt")
 	if err != nil {
@@ -123,11 +264,47 @@ func New(conf *config.Config) (*CoreHandler, error) {
 		},
 	}
 
-	h := &CoreHandler{client: client}
+	store, err := newUserStore(conf.DataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	previews, err := newLinkPreviewer(conf.LinkPreviewCachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors, err := newCursorSigner(conf.CursorSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &CoreHandler{
+		client:     client,
+		store:      store,
+		prefs:      newTTLCache(prefsTTL),
+		sessions:   newLRUCache(sessionTTL, maxSessions),
+		subreddits: newTTLCache(subredditTTL),
+		previews:   previews,
+		cursors:    cursors,
+	}
 	h.conf = conf
+	// Streams and watches are shared between users so they are polled anonymously
+	anonymousFetch := func(l listing, query string) (*RedditResponse, error) {
+		return h.fetchListing(&AuthRequest{}, "", l, query)
+	}
+	h.streams = newStreamHub(anonymousFetch)
+	h.watches = newWatchRunner(store, client, conf.WebhookSecret, h.streams)
+	go h.watches.run()
+	go previews.cache.run(previewFlushInterval)
 	return h, nil
 }
 
+// Saves anything only held in memory, this should be called before we exit
+func (api *CoreHandler) Close() error {
+	return api.previews.cache.Flush()
+}
+
 // Consumes an existing values object and adds keys that are required for reddit oauth
 func (api *CoreHandler) addRedditKeys(vals url.Values, userID string) url.Values {
 	// These values are mandated by reddit oauth docs
@@ -143,44 +320,16 @@ func (api *CoreHandler) addRedditKeys(vals url.Values, userID string) url.Values
 	return vals
 }
 
-func (api *CoreHandler) GetIdentity(bearerToken string) (string, error) {
-	// Make a request to get identity from Reddit
-	req, err := http.NewRequest(http.MethodGet, api.conf.RedditOAuthURL+identityEndpoint, nil)
-	if err != nil {
-		return "", err
-	}
-
-	// Attach our bearer token
-	req.Header.Add("Authorization", "bearer "+bearerToken)
-	// This is required by the Reddit API terms and conditions
-	req.Header.Add("User-Agent", userAgent)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+// Gets the Reddit account the auth belongs to, refreshing the token if it has expired
+func (api *CoreHandler) GetIdentity(auth *AuthRequest, userID string) (*IdentityResponse, error) {
+	id := &IdentityResponse{}
+	if err := api.getRedditJSON(auth, userID, identityEndpoint, "", id); err != nil {
 		log.Printf("Errored when retrieving identity from Reddit: %v", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Did not receive 200 OK when trying to get identity from reddit. Received: %v", resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Unable to read response body from Reddit: %v", err)
-		return "", err
-	}
-
-	id := IdentityResponse{}
-	err = json.Unmarshal(body, &id)
-	if err != nil {
-		log.Printf("Unable to unmarshall response: %v\n", err)
-		return "", err
+		return nil, err
 	}
 
 	log.Printf("Received identity for user: %v.", id.RedditUsername)
-	return id.RedditUsername, nil
+	return id, nil
 }
 
 // TODO: Store bearer token in url
@@ -194,6 +343,10 @@ func (api *CoreHandler) getRedditAuth(r *http.Request) (*AuthRequest, error) {
 
 	// Unmarshall response containing our bearer token
 	authRequest := &AuthRequest{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// Anonymous requests don't have to send anything
+		return authRequest, nil
+	}
 	err = json.Unmarshal(body, authRequest)
 	if err != nil {
 		log.Printf("Received invalid reddit auth information")
@@ -203,66 +356,241 @@ func (api *CoreHandler) getRedditAuth(r *http.Request) (*AuthRequest, error) {
 	return authRequest, nil
 }
 
-func getBestImage(image RedditImage) string {
+func getBestImage(image RedditImage, targetWidth int) string {
 	gif := image.Variants.GIF
-	bestImage := getBestResolution(append(gif.Resolutions, gif.Source))
+	bestImage := getBestResolution(append(gif.Resolutions, gif.Source), targetWidth)
 	if bestImage == "" {
-		bestImage = getBestResolution(append(image.Resolutions, image.Source))
+		bestImage = getBestResolution(append(image.Resolutions, image.Source), targetWidth)
 	}
 	return html.UnescapeString(bestImage)
 }
 
-func getBestVideo(image RedditImage) string {
+func getBestVideo(image RedditImage, targetWidth int) string {
 	mp4 := image.Variants.MP4
-	bestVideo := getBestResolution(append(mp4.Resolutions, mp4.Source))
+	bestVideo := getBestResolution(append(mp4.Resolutions, mp4.Source), targetWidth)
 	return html.UnescapeString(bestVideo)
 }
 
-func getBestResolution(images []*ImageSource) string {
-	var bestImage string
-	var bestImageWidth int
+// Classifies the posts media and gets a direct url for it where one exists. The media we have already
+// pulled out of the post is preferred over guessing from the url
+func classifyMedia(post RedditPost, gallery []MediaItem, redditVideo *VideoStream, video string) (string, string) {
+	if post.IsSelf {
+		return mediaTypeSelf, ""
+	}
+	if len(gallery) > 0 {
+		return mediaTypeGallery, gallery[0].URL
+	}
+	if redditVideo != nil {
+		if redditVideo.HLSURL != "" {
+			return mediaTypeVideo, redditVideo.HLSURL
+		}
+		return mediaTypeVideo, redditVideo.FallbackURL
+	}
+
+	link := html.UnescapeString(post.URL)
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return mediaTypeLink, ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	host = strings.TrimPrefix(host, "m.")
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	ext := strings.ToLower(path.Ext(u.Path))
+
+	switch {
+	case host == "i.imgur.com" && (ext == ".gifv" || ext == ".gif"):
+		return mediaTypeGIF, "https://i.imgur.com/" + strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path)) + ".mp4"
+	case host == "imgur.com" && len(segments) == 2 && (segments[0] == "a" || segments[0] == "gallery"):
+		return mediaTypeGallery, "https://imgur.com/a/" + segments[1]
+	case host == "imgur.com" && len(segments) == 1 && segments[0] != "" && ext == "":
+		return mediaTypeImage, "https://i.imgur.com/" + segments[0] + ".jpg"
+	case host == "gfycat.com" && segments[0] != "":
+		return mediaTypeEmbed, "https://gfycat.com/ifr/" + segments[len(segments)-1]
+	case host == "redgifs.com" && len(segments) == 2 && segments[0] == "watch":
+		return mediaTypeEmbed, "https://www.redgifs.com/ifr/" + segments[1]
+	case host == "youtube.com" && u.Query().Get("v") != "":
+		return mediaTypeEmbed, "https://www.youtube.com/embed/" + u.Query().Get("v")
+	case host == "youtube.com" && len(segments) == 2 && (segments[0] == "shorts" || segments[0] == "embed"):
+		return mediaTypeEmbed, "https://www.youtube.com/embed/" + segments[1]
+	case host == "youtu.be" && segments[0] != "":
+		return mediaTypeEmbed, "https://www.youtube.com/embed/" + segments[0]
+	case host == "streamable.com" && len(segments) == 1 && segments[0] != "":
+		return mediaTypeEmbed, "https://streamable.com/e/" + segments[0]
+	case host == "v.redd.it":
+		return mediaTypeVideo, video
+	case ext == ".gif":
+		// Reddit converts gifs to mp4 which is far smaller, use it when we have it
+		if video != "" {
+			return mediaTypeGIF, video
+		}
+		return mediaTypeGIF, link
+	case ext == ".mp4" || ext == ".webm":
+		return mediaTypeVideo, link
+	case ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" || host == "i.redd.it":
+		return mediaTypeImage, link
+	case post.PostHint == "image":
+		return mediaTypeImage, link
+	case post.PostHint == "rich:video":
+		return mediaTypeEmbed, ""
+	}
+	return mediaTypeLink, ""
+}
+
+// Picks the smallest image that is at least as wide as the target width, if there are none
+// we fall back to the widest image available
+func getBestResolution(images []*ImageSource, targetWidth int) string {
+	var best *ImageSource
 	for _, i := range images {
 		if i == nil {
 			continue
-		} else if i.Width > targetImageWidth && i.Width < bestImageWidth ||
-			bestImageWidth < targetImageWidth && i.Width > bestImageWidth {
+		} else if best == nil ||
+			i.Width >= targetWidth && (best.Width < targetWidth || i.Width < best.Width) ||
+			i.Width < targetWidth && best.Width < targetWidth && i.Width > best.Width {
 
-			bestImage = i.URL
-			bestImageWidth = i.Width
+			best = i
 		}
 	}
-	return bestImage
-}
 
-func getContentHTML(content string) string {
-	prefixLen := len("&lt;!-- SC_OFF --&gt;")
-	suffixLen := len("&lt;!-- SC_ON --&gt;")
-	if len(content) < prefixLen {
+	if best == nil {
 		return ""
 	}
-	innerContent := content[prefixLen : len(content)-suffixLen]
-	return html.UnescapeString(innerContent)
+	return best.URL
 }
 
-func (api *CoreHandler) getPostsAuth(query, token string) (*http.Request, error) {
-	url := "http://oauth.reddit.com/"
+// Gets every resolution of the given images ordered by width so clients can build a srcset
+func getResolutions(images []*ImageSource) []ImageSource {
+	resolutions := []ImageSource{}
+	seen := map[string]bool{}
+	for _, i := range images {
+		if i == nil || i.URL == "" || seen[i.URL] {
+			continue
+		}
+		seen[i.URL] = true
+		resolutions = append(resolutions, ImageSource{URL: html.UnescapeString(i.URL), Width: i.Width, Height: i.Height})
+	}
 
-	req, err := http.NewRequest(http.MethodGet, url+query, nil)
+	sort.SliceStable(resolutions, func(a, b int) bool {
+		return resolutions[a].Width < resolutions[b].Width
+	})
+	return resolutions
+}
+
+// Gets all resolutions of the static and animated variants of an image, returns nil if there are none
+func getImageSet(image RedditImage) *ImageSet {
+	gif := image.Variants.GIF
+	mp4 := image.Variants.MP4
+	set := &ImageSet{
+		Static: getResolutions(append(image.Resolutions, image.Source)),
+		GIF:    getResolutions(append(gif.Resolutions, gif.Source)),
+		MP4:    getResolutions(append(mp4.Resolutions, mp4.Source)),
+	}
+
+	if len(set.Static) == 0 && len(set.GIF) == 0 && len(set.MP4) == 0 {
+		return nil
+	}
+	return set
+}
+
+// Parses the width hint for picking images, defaults to targetImageWidth when not given
+func getTargetWidth(queryParams url.Values) (int, error) {
+	param := queryParams.Get("width")
+	if param == "" {
+		return targetImageWidth, nil
+	}
+
+	width, err := strconv.Atoi(param)
+	if err != nil || width <= 0 || width > maxImageWidth {
+		return 0, fmt.Errorf("width must be an integer between 1 and %v", maxImageWidth)
+	}
+	return width, nil
+}
+
+// Options given as query params that control how reddit posts are mapped into our posts
+type postOptions struct {
+	targetWidth   int
+	contentFormat string
+	excerptLength int
+	filters       FilterSettings
+	// Whether to fetch previews for external links that have no image
+	linkPreviews bool
+	// Whether posts linking to the same page are collapsed into the first one
+	collapseReposts bool
+	// The number of posts wanted on the page, zero leaves it up to us
+	limit int
+}
+
+func getPostOptions(queryParams url.Values) (*postOptions, error) {
+	targetWidth, err := getTargetWidth(queryParams)
 	if err != nil {
 		return nil, err
 	}
 
-	// Attach our bearer token
-	req.Header.Add("Authorization", "bearer "+token)
+	contentFormat, err := parseContentFormat(queryParams.Get("content_format"))
+	if err != nil {
+		return nil, err
+	}
 
-	// This is required by the Reddit API terms and conditions
-	req.Header.Add("User-Agent", userAgent)
+	excerptLength := defaultExcerptLength
+	if param := queryParams.Get("excerpt_length"); param != "" {
+		excerptLength, err = strconv.Atoi(param)
+		if err != nil || excerptLength <= 0 || excerptLength > maxExcerptLength {
+			return nil, fmt.Errorf("excerpt_length must be an integer between 1 and %v", maxExcerptLength)
+		}
+	}
 
-	return req, nil
+	filters, err := getFilterSettings(queryParams)
+	if err != nil {
+		return nil, err
+	}
+
+	var linkPreviews bool
+	if param := queryParams.Get("link_previews"); param != "" {
+		if linkPreviews, err = strconv.ParseBool(param); err != nil {
+			return nil, fmt.Errorf("link_previews must be true or false")
+		}
+	}
+
+	var collapseReposts bool
+	if param := queryParams.Get("collapse_reposts"); param != "" {
+		if collapseReposts, err = strconv.ParseBool(param); err != nil {
+			return nil, fmt.Errorf("collapse_reposts must be true or false")
+		}
+	}
+
+	var limit int
+	if param := queryParams.Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxListingLimit {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %v", maxListingLimit)
+		}
+	}
+
+	return &postOptions{
+		limit:           limit,
+		targetWidth:     targetWidth,
+		contentFormat:   contentFormat,
+		excerptLength:   excerptLength,
+		filters:         filters,
+		linkPreviews:    linkPreviews,
+		collapseReposts: collapseReposts,
+	}, nil
+}
+
+// Reddit sends self post content as escaped html wrapped in SC_OFF/SC_ON comments, the
+// comments are removed along with anything unsafe when the content is sanitized
+func getContentHTML(content string) string {
+	if content == "" {
+		return ""
+	}
+	return sanitizeHTML(html.UnescapeString(content))
 }
 
-func (api *CoreHandler) getPosts(query string) (*http.Request, error) {
-	url := "http://www.reddit.com/.json"
+func (api *CoreHandler) getPostsAuth(path, query, token string) (*http.Request, error) {
+	return api.newRedditRequest(http.MethodGet, path+query, token, nil)
+}
+
+func (api *CoreHandler) getPosts(path, query string) (*http.Request, error) {
+	url := redditBaseURL + strings.TrimSuffix(path, "/") + "/.json"
 
 	req, err := http.NewRequest(http.MethodGet, url+query, nil)
 	if err != nil {
@@ -284,10 +612,6 @@ func (api *CoreHandler) completeRequest(auth *AuthRequest, username string, req
 	// If we get a 401 back from reddit lets try again but first refresh our token
 	if resp.StatusCode == 401 && auth.BearerToken != "" && auth.RefreshToken != "" {
 		resp.Body.Close()
-		query := req.URL.RawQuery
-		if len(query) > 0 {
-			query = "?" + query
-		}
 		// First refresh our token
 		auth, err := api.Refresh(auth.RefreshToken)
 		if err != nil {
@@ -295,7 +619,7 @@ func (api *CoreHandler) completeRequest(auth *AuthRequest, username string, req
 		}
 
 		go api.postRedditAuth(auth, username)
-		req, err := api.getPostsAuth(query, auth.BearerToken)
+		req, err := withBearerToken(req, auth.BearerToken)
 		if err != nil {
 			return nil, err
 		}
@@ -305,107 +629,427 @@ func (api *CoreHandler) completeRequest(auth *AuthRequest, username string, req
 	return resp, nil
 }
 
-// Fetches post from Reddit
-// GET /v1/{id}/posts
-func (api *CoreHandler) GetPosts(w http.ResponseWriter, r *http.Request) {
-	queryParams := r.URL.Query()
+// Tokens are issued by reddit itself rather than the oauth api, unless we have been configured elsewhere
+func (api *CoreHandler) accessTokenURL() string {
+	if api.conf.RedditAuthURL != "" {
+		return api.conf.RedditAuthURL + accessTokenEndpoint
+	}
+	return redditBaseURL + accessTokenEndpoint
+}
 
-	var pageToken string
-	if arr, ok := queryParams["continue"]; ok && len(arr) > 0 {
-		pageToken = arr[0]
+// Copies the given request so it can be resent using a new bearer token
+func withBearerToken(req *http.Request, token string) (*http.Request, error) {
+	var body io.ReadCloser
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
 	}
-	log.Printf("Received page token: %v", pageToken)
 
-	id := mux.Vars(r)["id"]
-	redditAuth, err := api.getRedditAuth(r)
+	retry, err := http.NewRequest(req.Method, req.URL.String(), body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	for k, v := range req.Header {
+		retry.Header[k] = append([]string(nil), v...)
+	}
+	retry.Header.Set("Authorization", "bearer "+token)
+
+	return retry, nil
+}
+
+// Maps a post from reddit into our normalized post, returns false if the post has been filtered out
+func newPost(post RedditPost, opts *postOptions) (Post, bool) {
+	post, crosspostedFrom := resolveCrosspost(post)
+
+	action := opts.filters.apply(post)
+	if action == filterHide {
+		return Post{}, false
+	}
+	blur := action == filterBlur
+
+	var heroImg string
+	var video string
+	var images *ImageSet
+	if len(post.Preview.Images) > 0 {
+		mainImage := post.Preview.Images[0]
+		if blur {
+			heroImg, images = getBlurredImage(mainImage, post.Over18, opts.targetWidth)
+		} else {
+			heroImg = getBestImage(mainImage, opts.targetWidth)
+			video = getBestVideo(mainImage, opts.targetWidth)
+			images = getImageSet(mainImage)
+		}
+	}
+
+	var gallery []MediaItem
+	if post.IsGallery {
+		gallery = getGallery(post.GalleryData, post.MediaMetadata, opts.targetWidth, blur)
+		if heroImg == "" && len(gallery) > 0 {
+			heroImg = gallery[0].URL
+		}
+	}
+
+	// The text of a blurred post gives away just as much as its media does
+	var content, excerpt string
+	if !blur {
+		content, excerpt = getContent(post, opts.contentFormat, opts.excerptLength)
+	}
+
+	var redditVideo *VideoStream
+	var embed *Embed
+	if !blur {
+		redditVideo = getRedditVideo(post.SecureMedia, post.Media)
+		embed = getEmbed(post)
+	}
+	if video == "" && redditVideo != nil {
+		video = redditVideo.FallbackURL
+	}
+
+	mediaType, mediaURL := classifyMedia(post, gallery, redditVideo, video)
+	if embed != nil && (mediaType == mediaTypeLink || mediaType == mediaTypeEmbed) {
+		// Reddit's embed data knows about more providers than we can recognise from the url
+		mediaType, mediaURL = mediaTypeEmbed, embed.EmbedURL
+	}
+	if blur {
+		// The url would let the frontend show exactly what we have blurred
+		mediaURL = ""
+	}
+
+	generic := Post{
+		Post: models.Post{
+			ID:        post.ID,
+			Date:      redditTime(post.UnixTime),
+			Author:    post.Author,
+			Title:     html.UnescapeString(post.Title),
+			HeroImg:   heroImg,
+			Video:     video,
+			IsVideo:   post.IsVideo,
+			PostLink:  redditBaseURL + post.RelativePath,
+			Platform:  "reddit",
+			URL:       normalizeURL(post.URL),
+			Score:     post.Score,
+			Subreddit: post.Subreddit,
+			Content:   content,
+		},
+		OriginalURL: html.UnescapeString(post.URL),
+		Excerpt:     excerpt,
+		Images:      images,
+		Gallery:     gallery,
+		RedditVideo: redditVideo,
+		Embed:       embed,
+
+		NumComments:   post.NumComments,
+		UpvoteRatio:   post.UpvoteRatio,
+		NSFW:          post.Over18,
+		Spoiler:       post.Spoiler,
+		Stickied:      post.Stickied,
+		Locked:        post.Locked,
+		Archived:      post.Archived,
+		Edited:        getEdited(post.Edited),
+		LinkFlair:     getFlair(post.LinkFlairText, post.LinkFlairRichtext, post.LinkFlairBackground, post.LinkFlairTextColor),
+		AuthorFlair:   getFlair(post.AuthorFlairText, post.AuthorFlairRichtext, post.AuthorFlairBackground, post.AuthorFlairTextColor),
+		Domain:        post.Domain,
+		Thumbnail:     getThumbnail(post.Thumbnail),
+		Distinguished: post.Distinguished,
+		TotalAwards:   post.TotalAwards,
+		Blurred:       blur,
+
+		CrosspostedFrom: crosspostedFrom,
+		MediaType:       mediaType,
+		MediaURL:        mediaURL,
+	}
+	if blur {
+		generic.Thumbnail = ""
+	}
+
+	return generic, true
+}
+
+// Fetches a page of the listing from reddit, the query says where the page starts
+func (api *CoreHandler) fetchListing(auth *AuthRequest, userID string, l listing, query string) (*RedditResponse, error) {
+	return api.fetchPosts(auth, userID, l.path(), query)
+}
+
+// Fetches the posts at the given reddit path, anonymously when the user hasn't linked their account
+func (api *CoreHandler) fetchPosts(auth *AuthRequest, userID, path, query string) (*RedditResponse, error) {
+	vals := &RedditResponse{}
+	if err := api.getRedditJSON(auth, userID, path, query, vals); err != nil {
+		return nil, err
 	}
+	return vals, nil
+}
+
+// An error status from Reddit along with the reason it gave, such as private or banned
+type redditStatusError struct {
+	StatusCode int
+	Reason     string `json:"reason"`
+}
+
+// Reddit explains some errors in the body, such as why a subreddit is forbidden
+func newRedditStatusError(statusCode int, body []byte) *redditStatusError {
+	statusErr := &redditStatusError{}
+	json.Unmarshal(body, statusErr)
+	statusErr.StatusCode = statusCode
+	return statusErr
+}
 
-	var query string
-	if pageToken != "" {
-		query += "?after=" + pageToken
+func (e *redditStatusError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("reddit responded with %v: %v", e.StatusCode, e.Reason)
 	}
+	return fmt.Sprintf("reddit responded with %v", e.StatusCode)
+}
 
+// Gets the json at the given reddit path, anonymously when the user hasn't linked their account.
+// Anything other than a 200 is returned as a redditStatusError
+func (api *CoreHandler) getRedditJSON(auth *AuthRequest, userID, path, query string, v interface{}) error {
 	var req *http.Request
-	if redditAuth.BearerToken == "" {
-		req, err = api.getPosts(query)
+	var err error
+	if auth.BearerToken == "" {
+		req, err = api.getPosts(path, query)
 	} else {
-		req, err = api.getPostsAuth(query, redditAuth.BearerToken)
+		req, err = api.getPostsAuth(path, query, auth.BearerToken)
+	}
+	if err != nil {
+		return err
 	}
 
-	resp, err := api.completeRequest(redditAuth, id, req)
+	resp, err := api.completeRequest(auth, userID, req)
 	if err != nil {
-		log.Printf("Errored when sending request to the server: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Received response from Reddit with status code: %v while getting posts", resp.StatusCode)
-
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Unable to complete request: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return newRedditStatusError(resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// Turns the raw posts of a page into the posts we send, in order. Muted, filtered and already seen posts
+// are removed and reposts collapsed when asked for. Mapped posts are kept in mapped so the page can be
+// rebuilt cheaply as more posts are fetched, a nil entry means newPost hid the post
+func buildPage(children []RedditPost, opts *postOptions, muted *muteMatcher, seen seenPosts, mapped map[string]*Post) ([]Post, *pageDeduper) {
+	deduper := newPageDeduper(seen)
+	reposts := map[string]int{}
+
+	posts := []Post{}
+	for _, child := range children {
+		if muted.matches(child) || deduper.seenID(child.ID) {
+			continue
+		}
+
+		post, ok := mapped[child.ID]
+		if !ok {
+			if p, ok := newPost(child, opts); ok {
+				post = &p
+			}
+			mapped[child.ID] = post
+		}
+		if post == nil {
+			continue
+		}
+
+		if opts.collapseReposts {
+			key := getRepostKey(child)
+			if i, ok := reposts[key]; ok {
+				posts[i].Reposts = append(posts[i].Reposts, RepostRef{
+					ID:        post.ID,
+					Subreddit: post.Subreddit,
+					PostLink:  post.PostLink,
+					Score:     post.Score,
+				})
+				continue
+			}
+			// Reposts of something sent on an earlier page are dropped as that card is already shown
+			if deduper.seenURL(key) {
+				continue
+			}
+			reposts[key] = len(posts)
+		}
+		// Copy the post so collapsing reposts never changes what we have cached
+		p := *post
+		p.Reposts = nil
+		posts = append(posts, p)
+	}
+	return posts, deduper
+}
+
+// Fetches post from Reddit
+// GET /v1/{id}/posts
+func (api *CoreHandler) GetPosts(w http.ResponseWriter, r *http.Request) {
+	api.getListingPosts(w, r, getListing, listingFront, listingSubreddit)
+}
+
+// Fetches posts from r/popular, optionally narrowed to a region with geo_filter
+// GET /v1/{id}/popular
+func (api *CoreHandler) GetPopular(w http.ResponseWriter, r *http.Request) {
+	api.getListingPosts(w, r, getPopularListing, listingPopular)
+}
+
+// Fetches posts from r/all
+// GET /v1/{id}/all
+func (api *CoreHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	api.getListingPosts(w, r, getAllListing, listingAll)
+}
+
+// Responds with a page of posts, the first page of a listing is described by the request and read
+// with parseListing while later pages come from the cursor. Cursors are only accepted for the listing types
+// the endpoint serves itself
+func (api *CoreHandler) getListingPosts(w http.ResponseWriter, r *http.Request, parseListing func(url.Values) (listing, error), types ...string) {
+	queryParams := r.URL.Query()
+	id := mux.Vars(r)["id"]
+
+	opts, err := getPostOptions(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// We need to get rid of some the meta data that comes with the response
-	vals := RedditResponse{}
-	err = json.Unmarshal(body, &vals)
+	// The cursor carries the listing so anything asked for alongside it is ignored
+	cursor := &pageCursor{UserID: id}
+	if token := queryParams.Get("continue"); token != "" {
+		if cursor, err = api.cursors.Decode(token, id); err != nil || !cursor.Listing.isOneOf(types) {
+			http.Error(w, errInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if cursor.Listing, err = parseListing(queryParams); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cursor.Before, cursor.Count, err = getPageStart(queryParams); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
 	if err != nil {
-		log.Printf("Unable to unmarshall response: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Reddit response: %+v", vals.Data.After)
+	opts.filters = api.resolveFilters(opts.filters, id, redditAuth)
+
+	muted := newMuteMatcher(api.store.Get(id).MuteRules)
+	// Listings shift while paginating so posts can turn up again on the next page. Going back shows
+	// posts the client has seen before on purpose so previous pages are never deduped
+	backwards := cursor.Before != ""
+	var seen seenPosts
+	sessionFound := true
+	if !backwards {
+		seen, sessionFound = api.getSeenPosts(cursor.Session)
+	}
 
-	posts := []models.Post{}
-	for _, c := range vals.Data.Children {
-		post := c.Data
+	target := minPageSize
+	if opts.limit > 0 {
+		target = opts.limit
+	}
 
-		var heroImg string
-		var video string
-		if len(post.Preview.Images) > 0 {
-			mainImage := post.Preview.Images[0]
-			heroImg = getBestImage(mainImage)
-			video = getBestVideo(mainImage)
+	posts := []Post{}
+	deduper := newPageDeduper(seen)
+	mapped := map[string]*Post{}
+	// The raw posts of the page in the order Reddit shows them
+	children := []RedditPost{}
+	after, before := cursor.After, cursor.Before
+	more := false
+	// Filtered and muted posts are removed so we keep fetching until the page is reasonably full
+	for page := 0; page < maxListingPages; page++ {
+		limit := opts.limit
+		if limit > 0 {
+			// Only ask for as many posts as we still need so the page never grows past the limit
+			limit = target - len(posts)
 		}
 
-		generic := models.Post{
-			ID:        post.ID,
-			Date:      time.Unix(int64(post.UnixTime), 10),
-			Author:    post.Author,
-			Title:     html.UnescapeString(post.Title),
-			HeroImg:   heroImg,
-			Video:     video,
-			IsVideo:   post.IsVideo,
-			PostLink:  "https://reddit.com" + post.RelativePath,
-			Platform:  "reddit",
-			URL:       post.URL,
-			Score:     post.Score,
-			Subreddit: post.Subreddit,
-			Content:   getContentHTML(post.Content),
+		var query string
+		if backwards {
+			// Reddit expects the count of the post we are going back from rather than the first post it sends
+			count := cursor.Count - len(children)
+			if count < 0 {
+				count = 0
+			}
+			query = cursor.Listing.query("", before, count+1, limit)
+		} else {
+			query = cursor.Listing.query(after, "", cursor.Count+len(children), limit)
+		}
+
+		vals, err := api.fetchListing(redditAuth, id, cursor.Listing, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		posts = append(posts, generic)
+		batch := []RedditPost{}
+		for _, c := range vals.Data.Children {
+			batch = append(batch, c.Data)
+		}
+		if backwards {
+			children = append(batch, children...)
+			before, more = vals.Data.Before, vals.Data.Before != ""
+		} else {
+			children = append(children, batch...)
+			after, more = vals.Data.After, vals.Data.After != ""
+		}
+
+		posts, deduper = buildPage(children, opts, muted, seen, mapped)
+		if len(posts) >= target || !more || len(batch) == 0 {
+			break
+		}
+	}
+
+	if opts.linkPreviews {
+		api.previews.Enrich(posts)
 	}
 
-	var nextURL string
-	if vals.Data.After != "" {
-		// TODO: This is needed because we use this same code for both authenitcated
-		// and non authenticated requests. It is gross and should be fixed soon
-		if id == "" {
-			nextURL = fmt.Sprintf("%v/v1/posts?continue=%v", api.conf.RedditClientURL, vals.Data.After)
+	var nextURL, prevURL string
+	if len(children) > 0 {
+		first := linkPrefix + children[0].ID
+		last := linkPrefix + children[len(children)-1].ID
+
+		next := pageCursor{Listing: cursor.Listing, After: last, UserID: id}
+		prev := pageCursor{Listing: cursor.Listing, Before: first, UserID: id}
+		hasNext, hasPrev := more, cursor.Count > 0
+		if backwards {
+			// Count is the number of posts before the post we went back from
+			next.Count = cursor.Count
+			prev.Count = cursor.Count - len(children)
+			if prev.Count < 0 {
+				prev.Count = 0
+			}
+			hasNext, hasPrev = true, more
 		} else {
-			nextURL = fmt.Sprintf("%v/v1/%v/posts?continue=%v", api.conf.RedditClientURL, id, vals.Data.After)
+			next.Count = cursor.Count + len(children)
+			next.Session = api.saveSeenPosts(deduper.snapshot())
+			prev.Count = cursor.Count
+		}
+
+		if hasNext {
+			if nextURL, err = api.getPageURL(r, next); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if hasPrev {
+			if prevURL, err = api.getPageURL(r, prev); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 	}
-	clientResp := models.ClientResp{
-		Posts:   posts,
-		NextURL: nextURL,
+	clientResp := ClientResp{
+		Posts:          posts,
+		NextURL:        nextURL,
+		PrevURL:        prevURL,
+		SessionExpired: !sessionFound,
 	}
 
 	res, err := json.Marshal(clientResp)
@@ -418,6 +1062,22 @@ func (api *CoreHandler) GetPosts(w http.ResponseWriter, r *http.Request) {
 	w.Write(res)
 }
 
+// Builds the url for the page described by the cursor. Options such as the image width are carried over
+// from the current request while the listing and position live in the cursor
+func (api *CoreHandler) getPageURL(r *http.Request, cursor pageCursor) (string, error) {
+	token, err := api.cursors.Encode(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	query := r.URL.Query()
+	for _, param := range []string{"subreddit", "subreddits", "sort", "rank", "t", "geo_filter", "before", "count"} {
+		query.Del(param)
+	}
+	query.Set("continue", token)
+	return api.conf.RedditClientURL + r.URL.Path + "?" + query.Encode(), nil
+}
+
 func (api *CoreHandler) GetPostsNoAuth(w http.ResponseWriter, r *http.Request) {
 	// TODO: This is gross, fix it. Make generic function to handle reddit posts, call it from GetPosts and GetPostsNoAuth
 	api.GetPosts(w, r)
@@ -427,14 +1087,16 @@ func (api *CoreHandler) GetPostsNoAuth(w http.ResponseWriter, r *http.Request) {
 func (api *CoreHandler) postRedditAuth(auth *AuthRequest, userID string) {
 	// Post the bearer token to be saved in core
 	log.Printf("Preparing to store reddit account in core for user: %v", userID)
-	redditUsername, err := api.GetIdentity(auth.BearerToken)
+	// The token has only just been issued, leaving out the refresh token means a failure can't send us round
+	// in a loop of refreshing and posting the account again
+	identity, err := api.GetIdentity(&AuthRequest{BearerToken: auth.BearerToken}, userID)
 	if err != nil {
 		log.Printf("%v", err)
 		return
 	}
 
 	jsonStr := []byte(fmt.Sprintf(`{ "type": "reddit", "username": "%v", "token": "%v", "refresh-token": "%v"}`,
-		redditUsername, auth.BearerToken, auth.RefreshToken))
+		identity.RedditUsername, auth.BearerToken, auth.RefreshToken))
 	req, err := http.NewRequest(http.MethodPost, api.conf.CoreURL+"/v1/users/"+userID+"/authorize/reddit", bytes.NewBuffer(jsonStr))
 	if err != nil {
 		log.Printf("Unable to post bearer token for user: %v - %v", userID, err)
@@ -501,7 +1163,7 @@ func (api *CoreHandler) requestToken(code string) (*RedditAuthResponse, error) {
 	jsonStr := []byte("grant_type=authorization_code&code=" + code + "&redirect_uri=" + api.conf.RedirectURI)
 
 	// Prepare the request for the bearer token
-	req, err := http.NewRequest(http.MethodPost, redditBaseURL+accessTokenEndpoint, bytes.NewBuffer(jsonStr))
+	req, err := http.NewRequest(http.MethodPost, api.accessTokenURL(), bytes.NewBuffer(jsonStr))
 	req.Header.Set("User-Agent", userAgent)
 	req.SetBasicAuth(api.conf.RedditClientID, api.conf.RedditSecret)
 
@@ -530,7 +1192,7 @@ func (api *CoreHandler) requestToken(code string) (*RedditAuthResponse, error) {
 }
 
 func (api *CoreHandler) Refresh(refreshToken string) (*AuthRequest, error) {
-	url := "https://www.reddit.com/api/v1/access_token"
+	url := api.accessTokenURL()
 	contents := []byte(fmt.Sprintf("grant_type=refresh_token&refresh_token=%v", refreshToken))
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(contents))
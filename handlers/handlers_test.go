@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -16,36 +19,280 @@ import (
 type HandlersTestSuite struct {
 	suite.Suite
 	router  *mux.Router
+	api     *mux.Router
 	handler CoreHandler
+
+	// The last form posted to one of our mocked reddit endpoints
+	lastForm url.Values
+	// The last listing requested from our mocked reddit
+	lastListing *url.URL
+	// How many times our mocked reddit has been asked about a subreddit
+	aboutRequests int
 }
 
 func MockGetRedditIdentity(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(`{ "name": "test" }`))
+	w.Write([]byte(`{ "name": "test", "total_karma": 1200, "verified": true }`))
+}
+
+// Hands out a fresh token for any refresh token
+func MockRedditAccessToken(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"access_token": "fresh", "token_type": "bearer", "expires_in": 3600}`))
+}
+
+// Expired tokens are refused so we can tell the request was sent again once the token was refreshed
+func (suite *HandlersTestSuite) MockRedditForm(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "bearer expired" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "Unauthorized", "error": 401}`))
+		return
+	}
+	r.ParseForm()
+	if r.PostForm.Get("id") == "t3_gone" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Not Found", "error": 404}`))
+		return
+	}
+	suite.lastForm = r.PostForm
+	w.Write([]byte(`{}`))
+}
+
+func MockRedditComment(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch r.PostForm.Get("thing_id") {
+	case "t3_locked":
+		w.Write([]byte(`{"json": {"errors": [["THREAD_LOCKED", "comments are locked.", "parent"]]}}`))
+	default:
+		w.Write([]byte(`{"json": {"errors": [], "data": {"things": [{"kind": "t1", "data": {"id": "def", "name": "t1_def", "permalink": "/r/test/comments/abc/hi/def/"}}]}}}`))
+	}
+}
+
+func MockRedditSubmit(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch r.PostForm.Get("sr") {
+	case "ratelimited":
+		w.Write([]byte(`{"json": {"errors": [["RATELIMIT", "you are doing that too much. try again in 9 minutes.", "ratelimit"]]}}`))
+	case "missing":
+		w.Write([]byte(`{"json": {"errors": [["SUBREDDIT_NOEXIST", "that subreddit doesn't exist", "sr"]]}}`))
+	default:
+		w.Write([]byte(`{"json": {"errors": [], "data": {"id": "abc", "name": "t3_abc", "url": "https://reddit.com/r/test/abc"}}}`))
+	}
+}
+
+// Serves pages of a listing of 40 posts. Pages after the first overlap the previous page by 5 posts as real
+// listings do when they shift
+func (suite *HandlersTestSuite) MockRedditListing(w http.ResponseWriter, r *http.Request) {
+	suite.lastListing = r.URL
+	query := r.URL.Query()
+
+	limit := 20
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = l
+	}
+
+	// Timeline subreddits get their own posts which never shift, b's posts are always 5 seconds older than a's
+	prefix, offset := "p", 0
+	if sub := mux.Vars(r)["subreddit"]; strings.HasPrefix(sub, "timeline") {
+		prefix = sub + "_p"
+		if sub == "timelineb" {
+			offset = 5
+		}
+	}
+
+	start := 0
+	if after := query.Get("after"); after != "" {
+		n, _ := strconv.Atoi(after[strings.LastIndex(after, "p")+1:])
+		start = n - 4
+		if prefix != "p" {
+			start = n + 1
+		}
+	} else if before := query.Get("before"); before != "" {
+		n, _ := strconv.Atoi(before[strings.LastIndex(before, "p")+1:])
+		start = n - limit
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + limit
+	if end > 40 {
+		end = 40
+	}
+
+	var after, before string
+	if end < 40 {
+		after = fmt.Sprintf("t3_%v%v", prefix, end-1)
+	}
+	if start > 0 {
+		before = fmt.Sprintf("t3_%v%v", prefix, start)
+	}
+
+	children := []string{}
+	for i := start; i < end; i++ {
+		children = append(children, fmt.Sprintf(`{"kind": "t3", "data": {"id": "%v%v", "title": "Post %v", "url": "https://example.com/%v%v", "created_utc": %v}}`,
+			prefix, i, i, prefix, i, 10000-i*10-offset))
+	}
+	fmt.Fprintf(w, `{"kind": "Listing", "data": {"after": "%v", "before": "%v", "children": [%v]}}`, after, before, strings.Join(children, ","))
+}
+
+// Serves the posts with the given fullnames in reverse order, as reddit doesn't promise to keep ours.
+// Posts named missing don't exist and posts named removed have been removed by a moderator. Asking for
+// posts named ratelimited or broken fails the whole request
+func MockRedditByID(w http.ResponseWriter, r *http.Request) {
+	names := strings.Split(mux.Vars(r)["names"], ",")
+	children := []string{}
+	for i := len(names) - 1; i >= 0; i-- {
+		id := strings.TrimPrefix(names[i], "t3_")
+		switch {
+		case strings.HasPrefix(id, "ratelimited"):
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "Too Many Requests", "error": 429}`))
+			return
+		case strings.HasPrefix(id, "broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message": "Internal Server Error", "error": 500}`))
+			return
+		case strings.HasPrefix(id, "missing"):
+		case strings.HasPrefix(id, "removed"):
+			children = append(children, fmt.Sprintf(`{"kind": "t3", "data": {"id": "%v", "title": "Gone", "selftext": "[removed]", "removed_by_category": "moderator"}}`, id))
+		default:
+			children = append(children, fmt.Sprintf(`{"kind": "t3", "data": {"id": "%v", "title": "Post %v", "score": 42}}`, id, id))
+		}
+	}
+	fmt.Fprintf(w, `{"kind": "Listing", "data": {"after": null, "before": null, "children": [%v]}}`, strings.Join(children, ","))
+}
+
+func (suite *HandlersTestSuite) MockRedditSubreddits(w http.ResponseWriter, r *http.Request) {
+	suite.lastListing = r.URL
+	w.Write([]byte(`{"kind": "Listing", "data": {"children": [{"kind": "t5", "data": {"display_name": "pics", "subscribers": 30000000, "url": "/r/pics/"}},
+		{"kind": "t5", "data": {"display_name": "news", "subscribers": 25000000, "url": "/r/news/"}}]}}`))
+}
+
+// Suspended users come back with only their name while shadowbanned and unknown users don't exist
+func MockRedditUser(w http.ResponseWriter, r *http.Request) {
+	switch name := mux.Vars(r)["name"]; name {
+	case "suspended":
+		w.Write([]byte(`{"kind": "t2", "data": {"name": "suspended", "is_suspended": true}}`))
+	case "shadowbanned", "nobody":
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Not Found", "error": 404}`))
+	default:
+		fmt.Fprintf(w, `{"kind": "t2", "data": {"name": "%v", "icon_img": "https://styles.redditmedia.com/avatar.png?width=256&amp;s=abc", "created_utc": 1500000000.0,
+			"link_karma": 10, "comment_karma": 20, "total_karma": 30, "verified": true, "is_gold": true, "subreddit": {"public_description": "Hi", "over_18": false}}}`, name)
+	}
+}
+
+// Only the names of existing users are taken
+func MockRedditUsernameAvailable(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%v", r.URL.Query().Get("user") == "nobody")
+}
+
+// Private and missing subreddits are refused the way reddit refuses them, anything else is public
+func (suite *HandlersTestSuite) MockRedditAbout(w http.ResponseWriter, r *http.Request) {
+	suite.aboutRequests++
+	switch sub := mux.Vars(r)["subreddit"]; sub {
+	case "private":
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"reason": "private", "message": "Forbidden", "error": 403}`))
+	case "missing":
+		w.Write([]byte(`{"kind": "Listing", "data": {"children": []}}`))
+	default:
+		fmt.Fprintf(w, `{"kind": "t5", "data": {"display_name": "%v", "title": "Gophers &amp; friends", "public_description_html": "&lt;p onclick=\"x()\"&gt;All about Go&lt;/p&gt;",
+			"community_icon": "https://styles.redditmedia.com/icon.png?width=256&amp;s=abc", "icon_img": "", "banner_background_image": "", "banner_img": "https://b.thumbs.redditmedia.com/banner.png",
+			"primary_color": "#00add8", "subscribers": 200000, "active_user_count": 300, "over18": false, "submission_type": "any", "subreddit_type": "public", "created_utc": 1200000000.0, "url": "/r/%v/"}}`, sub, sub)
+	}
+}
+
+func MockRedditRules(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"rules": [{"kind": "link", "short_name": "Be nice", "description_html": "&lt;p&gt;No &lt;script&gt;x()&lt;/script&gt;trolling&lt;/p&gt;", "priority": 0}], "site_rules": []}`))
+}
+
+func MockGetRedditPrefs(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{ "over_18": true }`))
+}
+
+// Sends a request to our api and returns the recorded response
+func (suite *HandlersTestSuite) serveAPI(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	suite.api.ServeHTTP(w, req)
+	return w
 }
 
 func (suite *HandlersTestSuite) SetupSuite() {
 	// Disable logging while testing
 	log.SetOutput(ioutil.Discard)
 
-	suite.handler = CoreHandler{client: &http.Client{}}
+	store, _ := newUserStore("")
+	suite.handler = CoreHandler{client: &http.Client{}, store: store, prefs: newTTLCache(prefsTTL), sessions: newLRUCache(sessionTTL, maxSessions), subreddits: newTTLCache(subredditTTL)}
+	suite.handler.cursors, _ = newCursorSigner("secret")
 
 	// In order to test using path params we need to run a server and send requests to it
 	suite.router = mux.NewRouter()
 	suite.router.HandleFunc("/api/v1/me", MockGetRedditIdentity).Methods(http.MethodGet)
+	suite.router.HandleFunc("/api/v1/access_token", MockRedditAccessToken).Methods(http.MethodPost)
+	suite.router.HandleFunc("/user/{name}/about", MockRedditUser).Methods(http.MethodGet)
+	suite.router.HandleFunc("/api/username_available", MockRedditUsernameAvailable).Methods(http.MethodGet)
+	suite.router.HandleFunc("/api/vote", suite.MockRedditForm).Methods(http.MethodPost)
+	suite.router.HandleFunc("/api/save", suite.MockRedditForm).Methods(http.MethodPost)
+	suite.router.HandleFunc("/api/submit", MockRedditSubmit).Methods(http.MethodPost)
+	suite.router.HandleFunc("/api/comment", MockRedditComment).Methods(http.MethodPost)
+	suite.router.HandleFunc("/api/v1/me/prefs", MockGetRedditPrefs).Methods(http.MethodGet)
+	suite.router.HandleFunc("/", suite.MockRedditListing).Methods(http.MethodGet)
+	suite.router.HandleFunc("/r/{subreddit}/about", suite.MockRedditAbout).Methods(http.MethodGet)
+	suite.router.HandleFunc("/r/{subreddit}/about/rules", MockRedditRules).Methods(http.MethodGet)
+	suite.router.HandleFunc("/r/{subreddit}/{sort}", suite.MockRedditListing).Methods(http.MethodGet)
+	suite.router.HandleFunc("/by_id/{names}", MockRedditByID).Methods(http.MethodGet)
+	suite.router.HandleFunc("/subreddits/{where}", suite.MockRedditSubreddits).Methods(http.MethodGet)
 	//suite.router.HandleFunc("/v1/users", suite.handler.InsertUser).Methods(http.MethodPost)
 
 	// Spin up our testing server
 	s := httptest.NewServer(suite.router)
 
-	suite.handler.conf = &config.Config{RedditOAuthURL: s.URL, RedditSecret: "secret", RedditClientID: "clientid", RedirectURI: "ruri"}
+	suite.handler.conf = &config.Config{
+		RedditOAuthURL: s.URL,
+		RedditAuthURL:  s.URL,
+		RedditSecret:   "secret",
+		RedditClientID: "clientid",
+		RedirectURI:    "ruri",
+		WebhookURLs:    []string{"https://core/v1/webhooks/reddit"},
+		WebhookSecret:  "webhook-secret",
+	}
 
+	// Routes for the endpoints we expose
+	suite.api = mux.NewRouter()
+	suite.api.HandleFunc("/v1/{id}/posts", suite.handler.GetPostsByID).Queries("ids", "{ids}").Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/posts", suite.handler.GetPosts).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/posts/{postID}", suite.handler.GetPost).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/popular", suite.handler.GetPopular).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/all", suite.handler.GetAll).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/timeline", suite.handler.GetTimeline).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/stream", suite.handler.Stream).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/posts/{postID}/vote", suite.handler.Vote).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/{id}/posts/{postID}/save", suite.handler.Save).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/subreddits", suite.handler.GetSubreddits).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/subreddits/{name}", suite.handler.GetSubreddit).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/users/{redditName}", suite.handler.GetUser).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/me", suite.handler.GetMe).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/subreddits/{name}/submit", suite.handler.Submit).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/{id}/things/{fullname}/reply", suite.handler.Reply).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/{id}/settings/filters", suite.handler.GetFilterSettings).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/settings/filters", suite.handler.UpdateFilterSettings).Methods(http.MethodPut)
+	suite.api.HandleFunc("/v1/{id}/mutes", suite.handler.GetMuteRules).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/mutes", suite.handler.CreateMuteRule).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/{id}/mutes/{ruleID}", suite.handler.UpdateMuteRule).Methods(http.MethodPut)
+	suite.api.HandleFunc("/v1/{id}/mutes/{ruleID}", suite.handler.DeleteMuteRule).Methods(http.MethodDelete)
+	suite.api.HandleFunc("/v1/{id}/watches", suite.handler.GetWatches).Methods(http.MethodGet)
+	suite.api.HandleFunc("/v1/{id}/watches", suite.handler.CreateWatch).Methods(http.MethodPost)
+	suite.api.HandleFunc("/v1/{id}/watches/{watchID}", suite.handler.UpdateWatch).Methods(http.MethodPut)
+	suite.api.HandleFunc("/v1/{id}/watches/{watchID}", suite.handler.DeleteWatch).Methods(http.MethodDelete)
 }
 
 func (s *HandlersTestSuite) TestGetIdentity() {
 	// Should be able to get the username given a bearer token
-	username, err := s.handler.GetIdentity("bearer")
+	identity, err := s.handler.GetIdentity(&AuthRequest{BearerToken: "bearer"}, "user")
 	s.Nil(err)
-	s.Equal("test", username)
+	s.Equal("test", identity.RedditUsername)
+	s.Equal(1200, identity.TotalKarma)
+	s.True(identity.Verified)
 }
 
 func (s *HandlersTestSuite) TestNew() {
@@ -60,6 +307,13 @@ func (s *HandlersTestSuite) TestNew() {
 	s.NotNil(h)
 }
 
+func (s *HandlersTestSuite) TestWebhookSecretRequired() {
+	// Deliveries nobody can verify shouldn't be sent at all
+	h, err := New(&config.Config{WebhookURLs: []string{"https://core/v1/webhooks/reddit"}})
+	s.NotNil(err)
+	s.Nil(h)
+}
+
 func (s *HandlersTestSuite) TestAddRedditKeys() {
 	vals := make(url.Values)
 
@@ -80,6 +334,96 @@ func (s *HandlersTestSuite) TestAddRedditKeys() {
 	s.Equal(newVals["scope"][0], redditAPIScope)
 }
 
+func (s *HandlersTestSuite) TestVote() {
+	// Valid directions should be translated to the values reddit expects
+	w := s.serveAPI(http.MethodPost, "/v1/user/posts/abc/vote", `{"bearer-token": "bearer", "direction": "down"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("t3_abc", s.lastForm.Get("id"))
+	s.Equal("-1", s.lastForm.Get("dir"))
+
+	// Unknown directions should be rejected
+	w = s.serveAPI(http.MethodPost, "/v1/user/posts/abc/vote", `{"bearer-token": "bearer", "direction": "sideways"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestSave() {
+	// Fullnames should be passed through untouched
+	w := s.serveAPI(http.MethodPost, "/v1/user/posts/t3_xyz/save", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("t3_xyz", s.lastForm.Get("id"))
+
+	// Actions need a linked account so they shouldn't even be sent to reddit without one
+	s.lastForm = nil
+	w = s.serveAPI(http.MethodPost, "/v1/user/posts/t3_xyz/save", "")
+	s.Equal(http.StatusUnauthorized, w.Code)
+	w = s.serveAPI(http.MethodPost, "/v1/user/posts/abc/vote", `{"direction": "up"}`)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Nil(s.lastForm)
+
+	// Statuses from reddit should be passed on rather than hidden behind a 500
+	w = s.serveAPI(http.MethodPost, "/v1/user/posts/gone/save", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+}
+
+func (s *HandlersTestSuite) TestActionRefreshesToken() {
+	// An expired token should be refreshed and the form posted again with the new one
+	s.lastForm = nil
+	w := s.serveAPI(http.MethodPost, "/v1/user/posts/abc/save", `{"bearer-token": "expired", "refresh-token": "refresh"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("t3_abc", s.lastForm.Get("id"))
+
+	w = s.serveAPI(http.MethodPost, "/v1/user/posts/abc/vote", `{"bearer-token": "expired", "refresh-token": "refresh", "direction": "up"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("1", s.lastForm.Get("dir"))
+}
+
+func (s *HandlersTestSuite) TestSubmit() {
+	// A successful submission should return the new post
+	w := s.serveAPI(http.MethodPost, "/v1/user/subreddits/test/submit", `{"bearer-token": "bearer", "kind": "self", "title": "hi", "text": "body"}`)
+	s.Equal(http.StatusCreated, w.Code)
+	s.Contains(w.Body.String(), `"fullname":"t3_abc"`)
+
+	// Invalid kinds should be rejected before reaching reddit
+	w = s.serveAPI(http.MethodPost, "/v1/user/subreddits/test/submit", `{"bearer-token": "bearer", "kind": "video", "title": "hi"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	// Rate limits should be mapped to a 429 with the time to wait
+	w = s.serveAPI(http.MethodPost, "/v1/user/subreddits/ratelimited/submit", `{"bearer-token": "bearer", "kind": "self", "title": "hi"}`)
+	s.Equal(http.StatusTooManyRequests, w.Code)
+	s.Equal("540", w.Header().Get("Retry-After"))
+	s.Contains(w.Body.String(), `"code":"RATELIMIT"`)
+
+	// Missing subreddits should be a 404
+	w = s.serveAPI(http.MethodPost, "/v1/user/subreddits/missing/submit", `{"bearer-token": "bearer", "kind": "link", "title": "hi", "url": "https://example.com"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+}
+
+func (s *HandlersTestSuite) TestReply() {
+	// A successful reply should return the new comment
+	w := s.serveAPI(http.MethodPost, "/v1/user/things/t3_abc/reply", `{"bearer-token": "bearer", "text": "hello"}`)
+	s.Equal(http.StatusCreated, w.Code)
+	s.Contains(w.Body.String(), `"fullname":"t1_def"`)
+	s.Contains(w.Body.String(), `"url":"https://reddit.com/r/test/comments/abc/hi/def/"`)
+
+	// Errors from reddit should come back structured
+	w = s.serveAPI(http.MethodPost, "/v1/user/things/t3_locked/reply", `{"bearer-token": "bearer", "text": "hello"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Contains(w.Body.String(), `"code":"THREAD_LOCKED"`)
+
+	// Only posts and comments can be replied to
+	for _, fullname := range []string{"abc", "t2_abc", "t5_abc", "t3_ABC"} {
+		w = s.serveAPI(http.MethodPost, "/v1/user/things/"+fullname+"/reply", `{"bearer-token": "bearer", "text": "hello"}`)
+		s.Equal(http.StatusBadRequest, w.Code, fullname)
+		s.NotContains(w.Body.String(), "errors", fullname)
+	}
+}
+
+func (s *HandlersTestSuite) TestParseRetryAfter() {
+	s.Equal(540, parseRetryAfter("you are doing that too much. try again in 9 minutes."))
+	s.Equal(30, parseRetryAfter("you are doing that too much. try again in 30 seconds."))
+	s.Equal(0, parseRetryAfter("you are doing that too much."))
+}
+
 func TestSuite(t *testing.T) {
 	suite.Run(t, new(HandlersTestSuite))
 }
@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// Only the head of the page is needed so there is no reason to read more than this
+	maxPreviewBytes     = 512 * 1024
+	maxPreviewRedirects = 3
+	maxPreviewFieldSize = 1024
+	previewTimeout      = 5 * time.Second
+	// Limits how long enriching a page of posts can hold up the response
+	previewBatchTimeout = 8 * time.Second
+	previewWorkers      = 5
+
+	previewTTL       = 24 * time.Hour
+	failedPreviewTTL = time.Hour
+	maxPreviewCache  = 10000
+	// How often new previews are saved to disk, anything newer is lost if we crash
+	previewFlushInterval = time.Minute
+)
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// Address ranges we must never let a link make us connect to
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	// NAT64 and 6to4 addresses embed an IPv4 address which may well be a private one
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenGraph and Twitter card metadata for an external link
+type LinkPreview struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+type previewCacheEntry struct {
+	// Nil when we were unable to get a preview, this stops us retrying broken links on every request
+	Preview *LinkPreview `json:"preview"`
+	Expires time.Time    `json:"expires"`
+}
+
+// Cache of link previews that is saved to disk when given a path. Changes are only kept in memory
+// until the next Flush so fetching a page of previews doesn't mean rewriting the file for each one
+type previewCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]previewCacheEntry
+	dirty   bool
+
+	// Held while writing the file so flushes never interleave, readers only wait on mu
+	saveMu sync.Mutex
+}
+
+func newPreviewCache(path string) (*previewCache, error) {
+	c := &previewCache{path: path, entries: make(map[string]previewCacheEntry)}
+	if path == "" {
+		return c, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &c.entries); err != nil {
+		// The cache can always be rebuilt so rather than failing start up we start again
+		log.Printf("Unable to parse link preview cache, starting with an empty cache: %v", err)
+		c.entries = make(map[string]previewCacheEntry)
+	}
+	return c, nil
+}
+
+func (c *previewCache) Get(key string) (*LinkPreview, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.Preview, true
+}
+
+func (c *previewCache) Set(key string, preview *LinkPreview, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxPreviewCache {
+		// Make room by dropping anything expired, failing that drop whatever expires soonest
+		var oldest string
+		for k, e := range c.entries {
+			if now.After(e.Expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || e.Expires.Before(c.entries[oldest].Expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= maxPreviewCache {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = previewCacheEntry{Preview: preview, Expires: now.Add(ttl)}
+	c.dirty = true
+}
+
+// Saves the cache to disk if anything has changed since it was last saved
+func (c *previewCache) Flush() error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	contents, err := json.Marshal(c.entries)
+	c.dirty = err != nil
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave us with a truncated cache
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, storePermissions); err != nil {
+		c.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		c.markDirty()
+		return err
+	}
+	return nil
+}
+
+// Makes sure a failed save is retried on the next flush
+func (c *previewCache) markDirty() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty = true
+}
+
+// Saves the cache every interval, this never returns
+func (c *previewCache) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.Flush(); err != nil {
+			log.Printf("Unable to save link preview cache: %v", err)
+		}
+	}
+}
+
+// Fetches link previews for external urls
+type linkPreviewer struct {
+	client *http.Client
+	cache  *previewCache
+	// Allows connecting to private addresses, this must only be used in tests
+	allowPrivate bool
+}
+
+func newLinkPreviewer(cachePath string) (*linkPreviewer, error) {
+	cache, err := newPreviewCache(cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &linkPreviewer{cache: cache}
+	dialer := &net.Dialer{Timeout: previewTimeout}
+	p.client = &http.Client{
+		Timeout: previewTimeout,
+		Transport: &http.Transport{
+			// Never use a proxy as it would do the dialing for us and bypass our address checks
+			Proxy:                 nil,
+			DialContext:           p.dialContext(dialer),
+			TLSHandshakeTimeout:   previewTimeout,
+			ResponseHeaderTimeout: previewTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxPreviewRedirects {
+				return fmt.Errorf("stopped after %v redirects", maxPreviewRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing to follow redirect to %v", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+	return p, nil
+}
+
+// Resolves the host ourselves and only dials addresses that are public. Checking the address
+// we actually connect to, rather than the url, means DNS rebinding and redirects can't get around this
+func (p *linkPreviewer) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			if !p.allowPrivate && isPrivateIP(ip.IP) {
+				continue
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		}
+		return nil, errPrivateAddress
+	}
+}
+
+// Gets the preview for the given url, using the cache when possible. Returns nil if there is none
+func (p *linkPreviewer) Get(ctx context.Context, link string) *LinkPreview {
+	if preview, ok := p.cache.Get(link); ok {
+		return preview
+	}
+
+	preview, err := p.fetch(ctx, link)
+	if err != nil {
+		log.Printf("Unable to get link preview for %v: %v", link, err)
+		// Don't remember failures caused by us giving up, the link may be fine
+		if ctx.Err() == nil {
+			p.cache.Set(link, nil, failedPreviewTTL)
+		}
+		return nil
+	}
+
+	p.cache.Set(link, preview, previewTTL)
+	return preview
+}
+
+func (p *linkPreviewer) fetch(ctx context.Context, link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %v", u.Scheme)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code: %v", resp.StatusCode)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return nil, fmt.Errorf("unsupported content type: %v", resp.Header.Get("Content-Type"))
+	}
+
+	// Redirects may have moved us so relative images need to be resolved against where we ended up
+	preview := parsePreview(io.LimitReader(resp.Body, maxPreviewBytes), resp.Request.URL)
+	if preview.Title == "" && preview.Image == "" && preview.Description == "" {
+		return nil, errors.New("page has no preview metadata")
+	}
+	return preview, nil
+}
+
+func truncateField(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > maxPreviewFieldSize {
+		value, _ = truncateWords(value, maxPreviewFieldSize)
+	}
+	return value
+}
+
+// Reads OpenGraph and Twitter card metadata from the head of a html page
+func parsePreview(r io.Reader, base *url.URL) *LinkPreview {
+	meta := map[string]string{}
+	var title string
+	var inTitle bool
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		token := z.Token()
+		if tt == html.EndTagToken && token.DataAtom == atom.Head || tt == html.StartTagToken && token.DataAtom == atom.Body {
+			break
+		}
+
+		switch {
+		case tt == html.StartTagToken && token.DataAtom == atom.Title:
+			inTitle = true
+		case tt == html.EndTagToken && token.DataAtom == atom.Title:
+			inTitle = false
+		case tt == html.TextToken && inTitle && title == "":
+			title = token.Data
+		case (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && token.DataAtom == atom.Meta:
+			var key, content string
+			for _, a := range token.Attr {
+				switch strings.ToLower(a.Key) {
+				case "property", "name":
+					key = strings.ToLower(a.Val)
+				case "content":
+					content = a.Val
+				}
+			}
+			// The first value wins, pages often repeat tags with less specific values
+			if _, ok := meta[key]; !ok && key != "" && content != "" {
+				meta[key] = content
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := meta[k]; ok {
+				return v
+			}
+		}
+		return ""
+	}
+
+	preview := &LinkPreview{
+		Title:       truncateField(first("og:title", "twitter:title")),
+		Description: truncateField(first("og:description", "twitter:description", "description")),
+		SiteName:    truncateField(first("og:site_name")),
+	}
+	if preview.Title == "" {
+		preview.Title = truncateField(title)
+	}
+
+	if image := first("og:image:secure_url", "og:image", "twitter:image", "twitter:image:src"); image != "" {
+		if u, err := base.Parse(strings.TrimSpace(image)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			preview.Image = u.String()
+		}
+	}
+	return preview
+}
+
+// Whether we should try to get a preview for the post, reddit's own links already have previews
+func needsLinkPreview(post *Post) bool {
+	if post.HeroImg != "" || post.Blurred || post.Gallery != nil {
+		return false
+	}
+
+	u, err := url.Parse(post.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, reddit := range []string{"reddit.com", "redd.it"} {
+		if host == reddit || strings.HasSuffix(host, "."+reddit) {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds link previews to any posts that don't have an image of their own
+func (p *linkPreviewer) Enrich(posts []Post) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewBatchTimeout)
+	defer cancel()
+
+	work := make(chan *Post)
+	var wg sync.WaitGroup
+	for i := 0; i < previewWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for post := range work {
+				if preview := p.Get(ctx, post.URL); preview != nil {
+					post.LinkPreview = preview
+					post.HeroImg = preview.Image
+				}
+			}
+		}()
+	}
+
+	for i := range posts {
+		if needsLinkPreview(&posts[i]) {
+			work <- &posts[i]
+		}
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iced-mocha/shared/models"
+)
+
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Fallback title</title>
+	<meta property="og:title" content="An article">
+	<meta property="og:site_name" content="Example">
+	<meta name="twitter:description" content="All about things">
+	<meta property="og:image" content="/images/hero.png">
+</head>
+<body>
+	<meta property="og:title" content="Should not be read">
+</body>
+</html>`
+
+// Starts a fixture server for link preview tests, requests are counted so we can check caching
+func newPreviewFixture(requests *int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(previewPage))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/article", http.StatusFound)
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not html"))
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head>" + strings.Repeat("<!-- padding -->", maxPreviewBytes/8)))
+		w.Write([]byte(`<meta property="og:title" content="Too far in"></head></html>`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func (s *HandlersTestSuite) TestLinkPreview() {
+	var requests int
+	server := newPreviewFixture(&requests)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "previews")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "previews.json")
+
+	previewer, err := newLinkPreviewer(cachePath)
+	s.Nil(err)
+	previewer.allowPrivate = true
+
+	preview := previewer.Get(context.Background(), server.URL+"/article")
+	s.NotNil(preview)
+	s.Equal("An article", preview.Title)
+	s.Equal("All about things", preview.Description)
+	s.Equal("Example", preview.SiteName)
+	s.Equal(server.URL+"/images/hero.png", preview.Image)
+
+	// Previews are only written out when the cache is flushed
+	_, err = os.Stat(cachePath)
+	s.True(os.IsNotExist(err))
+	s.Nil(previewer.cache.Flush())
+
+	// The second lookup should come from the cache, even after a restart
+	previewer, err = newLinkPreviewer(cachePath)
+	s.Nil(err)
+	previewer.allowPrivate = true
+	s.NotNil(previewer.Get(context.Background(), server.URL+"/article"))
+	s.Equal(1, requests)
+
+	// Redirects are followed and relative images resolved against the final page
+	preview = previewer.Get(context.Background(), server.URL+"/redirect")
+	s.NotNil(preview)
+	s.Equal(server.URL+"/images/hero.png", preview.Image)
+
+	// Non html responses and pages beyond our size limit give no preview
+	s.Nil(previewer.Get(context.Background(), server.URL+"/image.png"))
+	s.Nil(previewer.Get(context.Background(), server.URL+"/huge"))
+}
+
+func (s *HandlersTestSuite) TestLinkPreviewPrivateAddresses() {
+	var requests int
+	server := newPreviewFixture(&requests)
+	defer server.Close()
+
+	// Without opting in, our fixture on localhost must be unreachable
+	previewer, err := newLinkPreviewer("")
+	s.Nil(err)
+	s.Nil(previewer.Get(context.Background(), server.URL+"/article"))
+	s.Equal(0, requests)
+
+	s.True(isPrivateIP(net.ParseIP("127.0.0.1")))
+	s.True(isPrivateIP(net.ParseIP("10.1.2.3")))
+	s.True(isPrivateIP(net.ParseIP("169.254.169.254")))
+	s.True(isPrivateIP(net.ParseIP("::1")))
+	s.True(isPrivateIP(net.ParseIP("::ffff:192.168.0.1")))
+	s.True(isPrivateIP(net.ParseIP("64:ff9b::a9fe:a9fe")))
+	s.True(isPrivateIP(net.ParseIP("2002:c0a8:1::1")))
+	s.False(isPrivateIP(net.ParseIP("151.101.1.140")))
+}
+
+func (s *HandlersTestSuite) TestNeedsLinkPreview() {
+	s.True(needsLinkPreview(&Post{Post: models.Post{URL: "https://example.com/article"}}))
+	s.False(needsLinkPreview(&Post{Post: models.Post{URL: "https://example.com/article", HeroImg: "https://i.redd.it/a.jpg"}}))
+	s.False(needsLinkPreview(&Post{Post: models.Post{URL: "https://www.reddit.com/r/golang/comments/abc/"}}))
+	s.False(needsLinkPreview(&Post{Post: models.Post{URL: "https://v.redd.it/abc"}}))
+	s.False(needsLinkPreview(&Post{Post: models.Post{URL: "https://example.com/article"}, Blurred: true}))
+}
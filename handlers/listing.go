@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	listingFront     = "front"
+	listingSubreddit = "subreddit"
+	listingPopular   = "popular"
+	listingAll       = "all"
+)
+
+var listingSorts = map[string]bool{"best": true, "hot": true, "new": true, "top": true, "rising": true, "controversial": true}
+
+var listingTimes = map[string]bool{"hour": true, "day": true, "week": true, "month": true, "year": true, "all": true}
+
+// Popular can be narrowed to a country, or a US state such as US_WA, GLOBAL is everywhere
+var geoFilterPattern = regexp.MustCompile(`^(GLOBAL|[A-Z]{2}(_[A-Z]{2})?)$`)
+
+var fullnamePattern = regexp.MustCompile(`^t3_[a-z0-9]+$`)
+
+// Subreddit names, several can be joined with + to get a combined listing
+var subredditPattern = regexp.MustCompile(`^[A-Za-z0-9_]{2,21}(\+[A-Za-z0-9_]{2,21})*$`)
+
+// Describes which Reddit listing to fetch posts from
+type listing struct {
+	Type      string `json:"type"`
+	Subreddit string `json:"subreddit,omitempty"`
+	Sort      string `json:"sort,omitempty"`
+	// Only used by the top and controversial sorts
+	Time string `json:"t,omitempty"`
+	// The region popular is narrowed to
+	Geo string `json:"g,omitempty"`
+}
+
+// Gets the listing requested through the subreddit, sort and t params, defaults to the front page
+func getListing(queryParams url.Values) (listing, error) {
+	l := listing{Type: listingFront, Sort: queryParams.Get("sort"), Time: queryParams.Get("t")}
+
+	if sub := strings.TrimPrefix(queryParams.Get("subreddit"), "r/"); sub != "" {
+		if !subredditPattern.MatchString(sub) {
+			return listing{}, fmt.Errorf("invalid subreddit name")
+		}
+		l.Type, l.Subreddit = listingSubreddit, sub
+	}
+
+	return l, l.validate()
+}
+
+// Gets r/popular as requested through the geo_filter, sort and t params
+func getPopularListing(queryParams url.Values) (listing, error) {
+	l := listing{Type: listingPopular, Sort: queryParams.Get("sort"), Time: queryParams.Get("t")}
+
+	if geo := strings.ToUpper(queryParams.Get("geo_filter")); geo != "" {
+		if !geoFilterPattern.MatchString(geo) {
+			return listing{}, fmt.Errorf("geo_filter must be GLOBAL or a region code such as US or US_WA")
+		}
+		l.Geo = geo
+	}
+	return l, l.validate()
+}
+
+// Gets r/all as requested through the sort and t params
+func getAllListing(queryParams url.Values) (listing, error) {
+	l := listing{Type: listingAll, Sort: queryParams.Get("sort"), Time: queryParams.Get("t")}
+	return l, l.validate()
+}
+
+func (l listing) validate() error {
+	if l.Sort != "" && !listingSorts[l.Sort] {
+		return fmt.Errorf("sort must be one of best, hot, new, top, rising or controversial")
+	}
+	if l.Time != "" {
+		if l.Sort != "top" && l.Sort != "controversial" {
+			return fmt.Errorf("t can only be used with the top and controversial sorts")
+		}
+		if !listingTimes[l.Time] {
+			return fmt.Errorf("t must be one of hour, day, week, month, year or all")
+		}
+	}
+	return nil
+}
+
+// Gets the path of the listing on Reddit
+func (l listing) path() string {
+	path := "/"
+	switch l.Type {
+	case listingSubreddit:
+		path = "/r/" + l.Subreddit + "/"
+	case listingPopular, listingAll:
+		path = "/r/" + l.Type + "/"
+	}
+	return path + l.Sort
+}
+
+// Whether the listing is one of the given types
+func (l listing) isOneOf(types []string) bool {
+	for _, t := range types {
+		if l.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the query to send Reddit for a page of the listing, a limit of zero leaves it up to Reddit
+func (l listing) query(after, before string, count, limit int) string {
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", after)
+	} else if before != "" {
+		query.Set("before", before)
+	}
+	if count > 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if l.Time != "" {
+		query.Set("t", l.Time)
+	}
+	if l.Geo != "" {
+		query.Set("geo_filter", l.Geo)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// Gets where a new listing should start from the before and count params. Later pages use a cursor instead
+func getPageStart(queryParams url.Values) (string, int, error) {
+	before := queryParams.Get("before")
+	if before != "" && !fullnamePattern.MatchString(before) {
+		return "", 0, fmt.Errorf("before must be the fullname of a post")
+	}
+
+	var count int
+	if param := queryParams.Get("count"); param != "" {
+		var err error
+		if count, err = strconv.Atoi(param); err != nil || count < 0 {
+			return "", 0, fmt.Errorf("count must be a positive integer")
+		}
+	}
+	return before, count, nil
+}
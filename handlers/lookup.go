@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	byIDEndpoint = "/by_id/"
+	// Reddit won't return more posts than this from a single by_id request
+	maxLookupIDs = 100
+
+	lookupFound    = "found"
+	lookupMissing  = "missing"
+	lookupRemoved  = "removed"
+	lookupDeleted  = "deleted"
+	lookupFiltered = "filtered"
+)
+
+var postIDPattern = regexp.MustCompile(`^(t3_)?[a-z0-9]+$`)
+
+// The result of looking up a single post. Removed and deleted posts still carry what Reddit has left of
+// them while missing and filtered posts have no post at all
+type PostLookup struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Post   *Post  `json:"post,omitempty"`
+}
+
+type LookupResp struct {
+	Posts []PostLookup `json:"posts"`
+}
+
+// Parses a comma separated list of post ids or fullnames into fullnames, in the order they were given
+func parsePostIDs(param string) ([]string, error) {
+	ids := []string{}
+	for _, id := range strings.Split(param, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if !postIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid post id: %v", id)
+		}
+		ids = append(ids, postFullname(id))
+	}
+	if len(ids) == 0 || len(ids) > maxLookupIDs {
+		return nil, fmt.Errorf("ids must list between 1 and %v posts", maxLookupIDs)
+	}
+	return ids, nil
+}
+
+// Works out whether a post Reddit sent us has since been taken down
+func getLookupStatus(post RedditPost) string {
+	if post.RemovedByCategory == "deleted" || post.Author == "[deleted]" || post.SelfText == "[deleted]" {
+		return lookupDeleted
+	}
+	if post.RemovedByCategory != "" || post.SelfText == "[removed]" {
+		return lookupRemoved
+	}
+	return lookupFound
+}
+
+// Fetches the posts with the given fullnames and returns a result for each of them in the same order
+func (api *CoreHandler) lookupPosts(auth *AuthRequest, userID string, fullnames []string, opts *postOptions) ([]PostLookup, error) {
+	// Reddit is only asked for each post once however many times it was requested
+	unique := []string{}
+	requested := map[string]bool{}
+	for _, name := range fullnames {
+		if !requested[name] {
+			requested[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	vals, err := api.fetchPosts(auth, userID, byIDEndpoint+strings.Join(unique, ","), "")
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := map[string]RedditPost{}
+	for _, c := range vals.Data.Children {
+		fetched[linkPrefix+c.Data.ID] = c.Data
+	}
+
+	results := make([]PostLookup, len(fullnames))
+	// The posts we have, along with where each one goes in the results
+	found := []Post{}
+	foundAt := []int{}
+	for i, name := range fullnames {
+		results[i] = PostLookup{ID: name, Status: lookupMissing}
+		child, ok := fetched[name]
+		if !ok {
+			continue
+		}
+		post, ok := newPost(child, opts)
+		if !ok {
+			results[i].Status = lookupFiltered
+			continue
+		}
+		results[i].Status = getLookupStatus(child)
+		found = append(found, post)
+		foundAt = append(foundAt, i)
+	}
+
+	if opts.linkPreviews && len(found) > 0 {
+		api.previews.Enrich(found)
+	}
+	for i := range found {
+		results[foundAt[i]].Post = &found[i]
+	}
+	return results, nil
+}
+
+// Parses the post options and auth shared by both lookups
+func (api *CoreHandler) getLookupOptions(w http.ResponseWriter, r *http.Request) (*postOptions, *AuthRequest, bool) {
+	opts, err := getPostOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	opts.filters = api.resolveFilters(opts.filters, mux.Vars(r)["id"], redditAuth)
+	return opts, redditAuth, true
+}
+
+// Gets the current state of a single post
+// GET /v1/{id}/posts/{postID}
+func (api *CoreHandler) GetPost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !postIDPattern.MatchString(vars["postID"]) {
+		http.Error(w, "invalid post id", http.StatusBadRequest)
+		return
+	}
+
+	opts, redditAuth, ok := api.getLookupOptions(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := api.lookupPosts(redditAuth, vars["id"], []string{postFullname(vars["postID"])}, opts)
+	if err != nil {
+		log.Printf("Unable to look up post %v: %v", vars["postID"], err)
+		writeRedditError(w, err)
+		return
+	} else if results[0].Status == lookupMissing {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := json.Marshal(results[0])
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Gets the current state of several posts, results are in the order the ids were given
+// GET /v1/posts?ids=
+// GET /v1/{id}/posts?ids=
+func (api *CoreHandler) GetPostsByID(w http.ResponseWriter, r *http.Request) {
+	fullnames, err := parsePostIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, redditAuth, ok := api.getLookupOptions(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := api.lookupPosts(redditAuth, mux.Vars(r)["id"], fullnames, opts)
+	if err != nil {
+		log.Printf("Unable to look up posts: %v", err)
+		writeRedditError(w, err)
+		return
+	}
+
+	res, err := json.Marshal(LookupResp{Posts: results})
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
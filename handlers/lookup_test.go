@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *HandlersTestSuite) TestGetPostsByID() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?ids=abc,t3_missing1,removed1,abc", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	resp := LookupResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 4)
+
+	// Results should come back in the order we asked for them whatever order reddit used
+	s.Equal("t3_abc", resp.Posts[0].ID)
+	s.Equal(lookupFound, resp.Posts[0].Status)
+	s.Equal(42, resp.Posts[0].Post.Score)
+
+	s.Equal("t3_missing1", resp.Posts[1].ID)
+	s.Equal(lookupMissing, resp.Posts[1].Status)
+	s.Nil(resp.Posts[1].Post)
+
+	s.Equal("t3_removed1", resp.Posts[2].ID)
+	s.Equal(lookupRemoved, resp.Posts[2].Status)
+	s.NotNil(resp.Posts[2].Post)
+
+	s.Equal("t3_abc", resp.Posts[3].ID)
+
+	// Anything that isn't a post id should be rejected before reaching reddit
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?ids=a!b", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetPost() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts/abc", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	result := PostLookup{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &result))
+	s.Equal(lookupFound, result.Status)
+	s.Equal("abc", result.Post.ID)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts/missing1", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+}
+
+func (s *HandlersTestSuite) TestParsePostIDs() {
+	ids, err := parsePostIDs(" abc, t3_def ,,")
+	s.Nil(err)
+	s.Equal([]string{"t3_abc", "t3_def"}, ids)
+
+	_, err = parsePostIDs("")
+	s.NotNil(err)
+	_, err = parsePostIDs("t1_abc")
+	s.NotNil(err)
+}
+
+func (s *HandlersTestSuite) TestGetPostsByIDRedditErrors() {
+	// Reddit failing must never look like the posts have gone
+	w := s.serveAPI(http.MethodGet, "/v1/user/posts?ids=abc,ratelimited1", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusTooManyRequests, w.Code)
+	s.NotContains(w.Body.String(), lookupMissing)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts?ids=abc,broken1", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusInternalServerError, w.Code)
+	s.NotContains(w.Body.String(), lookupMissing)
+
+	w = s.serveAPI(http.MethodGet, "/v1/user/posts/ratelimited1", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusTooManyRequests, w.Code)
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"golang.org/x/net/html"
+)
+
+const (
+	// Values of "e" in Reddit's media_metadata
+	metadataImage         = "Image"
+	metadataAnimatedImage = "AnimatedImage"
+
+	mediaTypeImage    = "image"
+	mediaTypeAnimated = "animated"
+	mediaTypeSelf     = "self"
+	mediaTypeGallery  = "gallery"
+	mediaTypeVideo    = "video"
+	mediaTypeGIF      = "gif"
+	mediaTypeLink     = "link"
+	mediaTypeEmbed    = "embed"
+)
+
+// A single resolution of an item in Reddit's media_metadata
+type MediaSource struct {
+	URL    string `json:"u"`
+	GIF    string `json:"gif"`
+	MP4    string `json:"mp4"`
+	Width  int    `json:"x"`
+	Height int    `json:"y"`
+}
+
+// An entry in Reddit's media_metadata, keyed by media id
+type RedditMediaMetadata struct {
+	Status   string         `json:"status"`
+	Type     string         `json:"e"`
+	MimeType string         `json:"m"`
+	Previews []*MediaSource `json:"p"`
+	Source   *MediaSource   `json:"s"`
+	// Blurred previews sent for NSFW and spoiler posts
+	Obfuscated []*MediaSource `json:"o"`
+}
+
+type RedditGalleryData struct {
+	Items []struct {
+		MediaID     string `json:"media_id"`
+		Caption     string `json:"caption"`
+		OutboundURL string `json:"outbound_url"`
+	} `json:"items"`
+}
+
+// A single image or animation in a gallery post
+type MediaItem struct {
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+	Video   string `json:"video,omitempty"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Caption string `json:"caption,omitempty"`
+	Link    string `json:"link,omitempty"`
+	// Every available resolution of static images ordered by width
+	Resolutions []ImageSource `json:"resolutions,omitempty"`
+}
+
+// Picks the best resolution out of the given media sources using the same heuristic as getBestResolution
+func getBestMediaSource(sources []*MediaSource, targetWidth int) *MediaSource {
+	images := []*ImageSource{}
+	byURL := map[string]*MediaSource{}
+	for _, s := range sources {
+		if s == nil || s.URL == "" {
+			continue
+		}
+		images = append(images, &ImageSource{URL: s.URL, Width: s.Width, Height: s.Height})
+		byURL[s.URL] = s
+	}
+	return byURL[getBestResolution(images, targetWidth)]
+}
+
+func getMediaResolutions(sources []*MediaSource) []ImageSource {
+	images := []*ImageSource{}
+	for _, s := range sources {
+		if s != nil {
+			images = append(images, &ImageSource{URL: s.URL, Width: s.Width, Height: s.Height})
+		}
+	}
+	return getResolutions(images)
+}
+
+// Builds the ordered list of media items for a gallery post, items that have failed processing are skipped.
+// When blurred only the obfuscated previews are used
+func getGallery(gallery RedditGalleryData, metadata map[string]RedditMediaMetadata, targetWidth int, blur bool) []MediaItem {
+	items := []MediaItem{}
+	for _, i := range gallery.Items {
+		meta, ok := metadata[i.MediaID]
+		if !ok || meta.Status != "valid" || meta.Source == nil {
+			continue
+		}
+
+		item := MediaItem{
+			Caption: i.Caption,
+			Link:    html.UnescapeString(i.OutboundURL),
+			Width:   meta.Source.Width,
+			Height:  meta.Source.Height,
+		}
+
+		switch {
+		case blur:
+			item.Type = mediaTypeImage
+			best := getBestMediaSource(meta.Obfuscated, targetWidth)
+			if best == nil {
+				continue
+			}
+			item.URL = html.UnescapeString(best.URL)
+			item.Width = best.Width
+			item.Height = best.Height
+			item.Link = ""
+			item.Caption = ""
+			item.Resolutions = getMediaResolutions(meta.Obfuscated)
+		case meta.Type == metadataAnimatedImage:
+			item.Type = mediaTypeAnimated
+			item.URL = html.UnescapeString(meta.Source.GIF)
+			item.Video = html.UnescapeString(meta.Source.MP4)
+		case meta.Type == metadataImage:
+			item.Type = mediaTypeImage
+			best := getBestMediaSource(append(meta.Previews, meta.Source), targetWidth)
+			if best == nil {
+				continue
+			}
+			item.URL = html.UnescapeString(best.URL)
+			item.Width = best.Width
+			item.Height = best.Height
+			item.Resolutions = getMediaResolutions(append(meta.Previews, meta.Source))
+		default:
+			continue
+		}
+
+		items = append(items, item)
+	}
+	return items
+}
+
+// Struct for reddit_video found in a posts media and secure_media
+type RedditVideoData struct {
+	FallbackURL string `json:"fallback_url"`
+	HLSURL      string `json:"hls_url"`
+	DashURL     string `json:"dash_url"`
+	Duration    int    `json:"duration"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	IsGIF       bool   `json:"is_gif"`
+	// Not always sent by Reddit so we need to be able to tell when it is missing
+	HasAudio *bool `json:"has_audio"`
+}
+
+type RedditMedia struct {
+	RedditVideo *RedditVideoData `json:"reddit_video"`
+	OEmbed      *RedditOEmbed    `json:"oembed"`
+}
+
+// A Reddit hosted video, clients should prefer the adaptive streams as the fallback has no audio
+type VideoStream struct {
+	HLSURL      string `json:"hls_url,omitempty"`
+	DashURL     string `json:"dash_url,omitempty"`
+	FallbackURL string `json:"fallback_url,omitempty"`
+	Duration    int    `json:"duration"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	HasAudio    bool   `json:"has_audio"`
+}
+
+// Gets the Reddit hosted video for a post preferring secure_media over media, returns nil if there is none
+func getRedditVideo(secureMedia, media *RedditMedia) *VideoStream {
+	var v *RedditVideoData
+	if secureMedia != nil && secureMedia.RedditVideo != nil {
+		v = secureMedia.RedditVideo
+	} else if media != nil && media.RedditVideo != nil {
+		v = media.RedditVideo
+	}
+	if v == nil {
+		return nil
+	}
+
+	stream := &VideoStream{
+		HLSURL:      html.UnescapeString(v.HLSURL),
+		DashURL:     html.UnescapeString(v.DashURL),
+		FallbackURL: html.UnescapeString(v.FallbackURL),
+		Duration:    v.Duration,
+		Width:       v.Width,
+		Height:      v.Height,
+	}
+
+	if v.HasAudio != nil {
+		stream.HasAudio = *v.HasAudio
+	} else {
+		// Reddit strips audio from gifs, otherwise the adaptive streams carry it when present
+		stream.HasAudio = !v.IsGIF && (stream.HLSURL != "" || stream.DashURL != "")
+	}
+
+	return stream
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+const galleryPost = `{
+	"id": "gal",
+	"is_gallery": true,
+	"gallery_data": {"items": [
+		{"media_id": "second", "caption": "a gif"},
+		{"media_id": "first", "caption": "a cat", "outbound_url": "https://example.com/?a=1&amp;b=2"},
+		{"media_id": "failed"}
+	]},
+	"media_metadata": {
+		"first": {
+			"status": "valid", "e": "Image", "m": "image/jpg",
+			"p": [
+				{"u": "https://preview.redd.it/first-108.jpg", "x": 108, "y": 80},
+				{"u": "https://preview.redd.it/first-640.jpg?a=1&amp;b=2", "x": 640, "y": 480}
+			],
+			"s": {"u": "https://preview.redd.it/first.jpg", "x": 2000, "y": 1500}
+		},
+		"second": {
+			"status": "valid", "e": "AnimatedImage", "m": "image/gif",
+			"s": {"gif": "https://i.redd.it/second.gif", "mp4": "https://preview.redd.it/second.gif?format=mp4", "x": 320, "y": 240}
+		},
+		"failed": {"status": "failed"}
+	}
+}`
+
+func (s *HandlersTestSuite) TestGetGallery() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(galleryPost), &post))
+	s.True(post.IsGallery)
+
+	// Items should come back in gallery order with failed media skipped
+	gallery := getGallery(post.GalleryData, post.MediaMetadata, targetImageWidth, false)
+	s.Len(gallery, 2)
+
+	s.Equal(mediaTypeAnimated, gallery[0].Type)
+	s.Equal("https://i.redd.it/second.gif", gallery[0].URL)
+	s.Equal("https://preview.redd.it/second.gif?format=mp4", gallery[0].Video)
+	s.Equal("a gif", gallery[0].Caption)
+
+	// Images should use the resolution closest to our target width
+	s.Equal(mediaTypeImage, gallery[1].Type)
+	s.Equal("https://preview.redd.it/first-640.jpg?a=1&b=2", gallery[1].URL)
+	s.Equal(640, gallery[1].Width)
+	s.Equal("https://example.com/?a=1&b=2", gallery[1].Link)
+}
+
+func (s *HandlersTestSuite) TestGetRedditVideo() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"is_video": true,
+		"media": {"reddit_video": {"fallback_url": "https://v.redd.it/old/DASH_240.mp4"}},
+		"secure_media": {"reddit_video": {
+			"fallback_url": "https://v.redd.it/abc/DASH_720.mp4?source=fallback",
+			"hls_url": "https://v.redd.it/abc/HLSPlaylist.m3u8?a=1&amp;b=2",
+			"dash_url": "https://v.redd.it/abc/DASHPlaylist.mpd",
+			"duration": 31, "width": 1280, "height": 720, "is_gif": false
+		}}
+	}`), &post))
+
+	// secure_media should be preferred and audio assumed when we have adaptive streams
+	video := getRedditVideo(post.SecureMedia, post.Media)
+	s.NotNil(video)
+	s.Equal("https://v.redd.it/abc/HLSPlaylist.m3u8?a=1&b=2", video.HLSURL)
+	s.Equal("https://v.redd.it/abc/DASH_720.mp4?source=fallback", video.FallbackURL)
+	s.Equal(31, video.Duration)
+	s.Equal(1280, video.Width)
+	s.True(video.HasAudio)
+
+	// An explicit has_audio from reddit should win
+	s.Nil(json.Unmarshal([]byte(`{"secure_media": {"reddit_video": {"hls_url": "x", "has_audio": false}}}`), &post))
+	s.False(getRedditVideo(post.SecureMedia, nil).HasAudio)
+
+	// Posts without a reddit video should not have one
+	s.Nil(getRedditVideo(nil, &RedditMedia{}))
+}
+
+func (s *HandlersTestSuite) TestGetBestResolution() {
+	images := []*ImageSource{
+		{URL: "320", Width: 320},
+		nil,
+		{URL: "1080", Width: 1080},
+		{URL: "640", Width: 640},
+		{URL: "108", Width: 108},
+	}
+
+	// We want the smallest image that still covers the target width
+	s.Equal("640", getBestResolution(images, 600))
+	s.Equal("320", getBestResolution(images, 320))
+	s.Equal("108", getBestResolution(images, 50))
+
+	// When nothing is wide enough the widest image should be used
+	s.Equal("1080", getBestResolution(images, 2000))
+	s.Equal("", getBestResolution([]*ImageSource{nil}, 600))
+}
+
+func (s *HandlersTestSuite) TestGetImageSet() {
+	image := RedditImage{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"source": {"url": "https://i.redd.it/src.jpg?a=1&amp;b=2", "width": 1200, "height": 900},
+		"resolutions": [
+			{"url": "https://i.redd.it/640.jpg", "width": 640, "height": 480},
+			{"url": "https://i.redd.it/108.jpg", "width": 108, "height": 81}
+		]
+	}`), &image))
+
+	set := getImageSet(image)
+	s.NotNil(set)
+	s.Len(set.Static, 3)
+	s.Equal(108, set.Static[0].Width)
+	s.Equal("https://i.redd.it/src.jpg?a=1&b=2", set.Static[2].URL)
+	s.Empty(set.GIF)
+
+	s.Nil(getImageSet(RedditImage{}))
+}
+
+func (s *HandlersTestSuite) TestGetTargetWidth() {
+	width, err := getTargetWidth(url.Values{})
+	s.Nil(err)
+	s.Equal(targetImageWidth, width)
+
+	width, err = getTargetWidth(url.Values{"width": {"320"}})
+	s.Nil(err)
+	s.Equal(320, width)
+
+	_, err = getTargetWidth(url.Values{"width": {"-1"}})
+	s.NotNil(err)
+	_, err = getTargetWidth(url.Values{"width": {"wide"}})
+	s.NotNil(err)
+}
+
+func (s *HandlersTestSuite) TestClassifyMedia() {
+	cases := []struct {
+		post      RedditPost
+		mediaType string
+		mediaURL  string
+	}{
+		{RedditPost{IsSelf: true, URL: "https://www.reddit.com/r/golang/comments/abc/"}, mediaTypeSelf, ""},
+		{RedditPost{URL: "https://i.redd.it/cat.jpg"}, mediaTypeImage, "https://i.redd.it/cat.jpg"},
+		{RedditPost{URL: "https://i.imgur.com/abc.gifv"}, mediaTypeGIF, "https://i.imgur.com/abc.mp4"},
+		{RedditPost{URL: "https://imgur.com/a/xyz"}, mediaTypeGallery, "https://imgur.com/a/xyz"},
+		{RedditPost{URL: "https://imgur.com/abc"}, mediaTypeImage, "https://i.imgur.com/abc.jpg"},
+		{RedditPost{URL: "https://gfycat.com/HappyCat"}, mediaTypeEmbed, "https://gfycat.com/ifr/HappyCat"},
+		{RedditPost{URL: "https://www.redgifs.com/watch/abc"}, mediaTypeEmbed, "https://www.redgifs.com/ifr/abc"},
+		{RedditPost{URL: "https://m.youtube.com/watch?v=abc&amp;t=10"}, mediaTypeEmbed, "https://www.youtube.com/embed/abc"},
+		{RedditPost{URL: "https://youtu.be/abc"}, mediaTypeEmbed, "https://www.youtube.com/embed/abc"},
+		{RedditPost{URL: "https://www.youtube.com/shorts/abc"}, mediaTypeEmbed, "https://www.youtube.com/embed/abc"},
+		{RedditPost{URL: "https://streamable.com/abc"}, mediaTypeEmbed, "https://streamable.com/e/abc"},
+		{RedditPost{URL: "https://example.com/clip.webm"}, mediaTypeVideo, "https://example.com/clip.webm"},
+		{RedditPost{URL: "https://example.com/photo", PostHint: "image"}, mediaTypeImage, "https://example.com/photo"},
+		{RedditPost{URL: "https://example.com/article"}, mediaTypeLink, ""},
+	}
+
+	for _, c := range cases {
+		mediaType, mediaURL := classifyMedia(c.post, nil, nil, "")
+		s.Equal(c.mediaType, mediaType, c.post.URL)
+		s.Equal(c.mediaURL, mediaURL, c.post.URL)
+	}
+
+	// Reddit gifs should point at the mp4 reddit made for them
+	mediaType, mediaURL := classifyMedia(RedditPost{URL: "https://i.redd.it/cat.gif"}, nil, nil, "https://preview.redd.it/cat.gif?format=mp4")
+	s.Equal(mediaTypeGIF, mediaType)
+	s.Equal("https://preview.redd.it/cat.gif?format=mp4", mediaURL)
+
+	// Media we have already extracted wins over the url
+	mediaType, mediaURL = classifyMedia(RedditPost{URL: "https://v.redd.it/abc"}, nil, &VideoStream{HLSURL: "https://v.redd.it/abc/HLSPlaylist.m3u8"}, "")
+	s.Equal(mediaTypeVideo, mediaType)
+	s.Equal("https://v.redd.it/abc/HLSPlaylist.m3u8", mediaURL)
+
+	mediaType, mediaURL = classifyMedia(RedditPost{URL: "https://www.reddit.com/gallery/abc"}, []MediaItem{{URL: "https://preview.redd.it/a.jpg"}}, nil, "")
+	s.Equal(mediaTypeGallery, mediaType)
+	s.Equal("https://preview.redd.it/a.jpg", mediaURL)
+
+	// Crossposts of self posts link to the original post but are still self posts
+	crosspost := RedditPost{
+		ID:  "xpost",
+		URL: "/r/golang/comments/abc/original/",
+		CrosspostParentList: []RedditPost{
+			{ID: "abc", IsSelf: true, URL: "https://www.reddit.com/r/golang/comments/abc/original/", SelfText: "Hello"},
+		},
+	}
+	post, ok := newPost(crosspost, &postOptions{targetWidth: targetImageWidth})
+	s.True(ok)
+	s.Equal(mediaTypeSelf, post.MediaType)
+	s.Empty(post.MediaURL)
+}
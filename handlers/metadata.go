@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Reddit sends edited as false for posts that have never been edited, otherwise it is the time of the edit
+type RedditEdited struct {
+	Time float64
+}
+
+func (e *RedditEdited) UnmarshalJSON(data []byte) error {
+	var edited interface{}
+	if err := json.Unmarshal(data, &edited); err != nil {
+		return err
+	}
+
+	if t, ok := edited.(float64); ok {
+		e.Time = t
+	} else {
+		e.Time = 0
+	}
+	return nil
+}
+
+// A single element of Reddit's flair richtext, either text or an emoji
+type RedditFlairPart struct {
+	Type  string `json:"e"`
+	Text  string `json:"t"`
+	Emoji string `json:"a"`
+	URL   string `json:"u"`
+}
+
+type FlairPart struct {
+	Type  string `json:"type"`
+	Text  string `json:"text,omitempty"`
+	Emoji string `json:"emoji,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+type Flair struct {
+	Text            string      `json:"text,omitempty"`
+	Richtext        []FlairPart `json:"richtext,omitempty"`
+	BackgroundColor string      `json:"backgroundColor,omitempty"`
+	// Either dark or light
+	TextColor string `json:"textColor,omitempty"`
+}
+
+// Converts the given unix time from reddit, which may have fractional seconds, into a time
+func redditTime(unixTime float64) time.Time {
+	sec, frac := math.Modf(unixTime)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC()
+}
+
+// Gets the time the post was edited or nil if it hasn't been
+func getEdited(edited RedditEdited) *time.Time {
+	if edited.Time == 0 {
+		return nil
+	}
+	t := redditTime(edited.Time)
+	return &t
+}
+
+// Builds a flair from Reddit's flair fields, returns nil if there is no flair
+func getFlair(text string, richtext []RedditFlairPart, backgroundColor, textColor string) *Flair {
+	parts := []FlairPart{}
+	for _, p := range richtext {
+		parts = append(parts, FlairPart{
+			Type:  p.Type,
+			Text:  html.UnescapeString(p.Text),
+			Emoji: p.Emoji,
+			URL:   html.UnescapeString(p.URL),
+		})
+	}
+
+	text = strings.TrimSpace(html.UnescapeString(text))
+	if text == "" && len(parts) == 0 {
+		return nil
+	}
+
+	flair := &Flair{Text: text, BackgroundColor: backgroundColor, TextColor: textColor}
+	if len(parts) > 0 {
+		flair.Richtext = parts
+	}
+	return flair
+}
+
+// Reddit uses placeholders such as "self", "default" or "nsfw" when a post has no thumbnail
+func getThumbnail(thumbnail string) string {
+	if strings.HasPrefix(thumbnail, "http://") || strings.HasPrefix(thumbnail, "https://") {
+		return html.UnescapeString(thumbnail)
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+)
+
+func (s *HandlersTestSuite) TestRedditTime() {
+	// Fractional seconds should be kept
+	t := redditTime(1514764800.5)
+	s.Equal(int64(1514764800), t.Unix())
+	s.Equal(500*time.Millisecond, time.Duration(t.Nanosecond()))
+}
+
+func (s *HandlersTestSuite) TestRedditEdited() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{"edited": false}`), &post))
+	s.Nil(getEdited(post.Edited))
+
+	s.Nil(json.Unmarshal([]byte(`{"edited": 1514764800.0}`), &post))
+	edited := getEdited(post.Edited)
+	s.NotNil(edited)
+	s.Equal(int64(1514764800), edited.Unix())
+}
+
+func (s *HandlersTestSuite) TestGetFlair() {
+	post := RedditPost{}
+	s.Nil(json.Unmarshal([]byte(`{
+		"link_flair_text": ":gopher: News &amp; Updates",
+		"link_flair_richtext": [{"e": "emoji", "a": ":gopher:", "u": "https://emoji.redditmedia.com/gopher.png"}, {"e": "text", "t": " News &amp; Updates"}],
+		"link_flair_background_color": "#ff4500",
+		"link_flair_text_color": "light",
+		"author_flair_text": null,
+		"author_flair_richtext": []
+	}`), &post))
+
+	flair := getFlair(post.LinkFlairText, post.LinkFlairRichtext, post.LinkFlairBackground, post.LinkFlairTextColor)
+	s.NotNil(flair)
+	s.Equal(":gopher: News & Updates", flair.Text)
+	s.Len(flair.Richtext, 2)
+	s.Equal(":gopher:", flair.Richtext[0].Emoji)
+	s.Equal(" News & Updates", flair.Richtext[1].Text)
+	s.Equal("light", flair.TextColor)
+
+	// No flair at all should be left out
+	s.Nil(getFlair(post.AuthorFlairText, post.AuthorFlairRichtext, "", ""))
+}
+
+func (s *HandlersTestSuite) TestGetThumbnail() {
+	s.Equal("https://b.thumbs.redditmedia.com/a.jpg", getThumbnail("https://b.thumbs.redditmedia.com/a.jpg"))
+	s.Equal("", getThumbnail("self"))
+	s.Equal("", getThumbnail("nsfw"))
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	muteSubreddit = "subreddit"
+	muteDomain    = "domain"
+	muteAuthor    = "author"
+	muteKeyword   = "keyword"
+	muteRegex     = "regex"
+
+	maxMuteRules     = 500
+	maxMuteValueSize = 256
+)
+
+var muteTypes = map[string]bool{
+	muteSubreddit: true,
+	muteDomain:    true,
+	muteAuthor:    true,
+	muteKeyword:   true,
+	muteRegex:     true,
+}
+
+// A rule that removes matching posts from a users listings
+type MuteRule struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Compiled form of a users mute rules so posts can be checked quickly
+type muteMatcher struct {
+	subreddits map[string]bool
+	authors    map[string]bool
+	domains    []string
+	keywords   []*regexp.Regexp
+	regexes    []*regexp.Regexp
+}
+
+// Normalizes the value of a rule so that it can be compared against posts
+func normalizeMuteValue(ruleType, value string) string {
+	value = strings.TrimSpace(value)
+	switch ruleType {
+	case muteSubreddit:
+		value = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(value), "/"), "r/")
+	case muteAuthor:
+		value = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(value), "/"), "u/")
+	case muteDomain:
+		value = strings.TrimPrefix(strings.ToLower(value), "www.")
+	}
+	return value
+}
+
+func (rule *MuteRule) validate() error {
+	if !muteTypes[rule.Type] {
+		return fmt.Errorf("type must be one of subreddit, domain, author, keyword or regex")
+	}
+
+	rule.Value = normalizeMuteValue(rule.Type, rule.Value)
+	if rule.Value == "" || len(rule.Value) > maxMuteValueSize {
+		return fmt.Errorf("value must be between 1 and %v characters", maxMuteValueSize)
+	}
+
+	if rule.Type == muteRegex {
+		if _, err := regexp.Compile(rule.Value); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	return nil
+}
+
+// Generates a random hex id that is safe to hand out to clients
+func newRandomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newMuteMatcher(rules []MuteRule) *muteMatcher {
+	m := &muteMatcher{subreddits: map[string]bool{}, authors: map[string]bool{}}
+	for _, rule := range rules {
+		switch rule.Type {
+		case muteSubreddit:
+			m.subreddits[rule.Value] = true
+		case muteAuthor:
+			m.authors[rule.Value] = true
+		case muteDomain:
+			m.domains = append(m.domains, rule.Value)
+		case muteKeyword:
+			// Keywords only match whole words so muting "cat" doesn't remove posts about "education"
+			m.keywords = append(m.keywords, regexp.MustCompile(`(?i)(^|\W)`+regexp.QuoteMeta(rule.Value)+`(\W|$)`))
+		case muteRegex:
+			// Rules are validated when saved but we would rather skip a bad rule than fail the listing
+			if re, err := regexp.Compile("(?i)" + rule.Value); err == nil {
+				m.regexes = append(m.regexes, re)
+			}
+		}
+	}
+	return m
+}
+
+// Whether the post matches any of the mute rules. Crossposts are matched against what they link to and
+// are muted along with the subreddit and author they were crossposted from
+func (m *muteMatcher) matches(post RedditPost) bool {
+	post, crosspostedFrom := resolveCrosspost(post)
+	if crosspostedFrom != nil && (m.subreddits[strings.ToLower(crosspostedFrom.Subreddit)] || m.authors[strings.ToLower(crosspostedFrom.Author)]) {
+		return true
+	}
+	if m.subreddits[strings.ToLower(post.Subreddit)] || m.authors[strings.ToLower(post.Author)] {
+		return true
+	}
+
+	domain := strings.TrimPrefix(strings.ToLower(post.Domain), "www.")
+	for _, d := range m.domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+
+	for _, re := range m.keywords {
+		if re.MatchString(post.Title) {
+			return true
+		}
+	}
+	for _, re := range m.regexes {
+		if re.MatchString(post.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMuteRules(w http.ResponseWriter, status int, v interface{}) {
+	res, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(res)
+}
+
+// Parses and validates the mute rule in the request body
+func readMuteRule(r *http.Request) (*MuteRule, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &MuteRule{}
+	if err := json.Unmarshal(body, rule); err != nil {
+		return nil, err
+	}
+
+	return rule, rule.validate()
+}
+
+// Lists the users mute rules
+// GET /v1/{id}/mutes
+func (api *CoreHandler) GetMuteRules(w http.ResponseWriter, r *http.Request) {
+	rules := api.store.Get(mux.Vars(r)["id"]).MuteRules
+	if rules == nil {
+		rules = []MuteRule{}
+	}
+	writeMuteRules(w, http.StatusOK, rules)
+}
+
+// Adds a new mute rule for the user
+// POST /v1/{id}/mutes
+func (api *CoreHandler) CreateMuteRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := readMuteRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if rule.ID, err = newRandomID(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var tooMany bool
+	err = api.store.Update(mux.Vars(r)["id"], func(data *UserData) {
+		if len(data.MuteRules) >= maxMuteRules {
+			tooMany = true
+			return
+		}
+		// Always build a new slice as readers may still hold the old one
+		data.MuteRules = append(append([]MuteRule{}, data.MuteRules...), *rule)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if tooMany {
+		http.Error(w, fmt.Sprintf("users can have at most %v mute rules", maxMuteRules), http.StatusBadRequest)
+		return
+	}
+
+	writeMuteRules(w, http.StatusCreated, rule)
+}
+
+// Replaces an existing mute rule
+// PUT /v1/{id}/mutes/{ruleID}
+func (api *CoreHandler) UpdateMuteRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rule, err := readMuteRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = vars["ruleID"]
+
+	var found bool
+	err = api.store.UpdateExisting(vars["id"], func(data *UserData) {
+		rules := make([]MuteRule, len(data.MuteRules))
+		for i, existing := range data.MuteRules {
+			if existing.ID == rule.ID {
+				existing = *rule
+				found = true
+			}
+			rules[i] = existing
+		}
+		data.MuteRules = rules
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "mute rule not found", http.StatusNotFound)
+		return
+	}
+
+	writeMuteRules(w, http.StatusOK, rule)
+}
+
+// Removes a mute rule
+// DELETE /v1/{id}/mutes/{ruleID}
+func (api *CoreHandler) DeleteMuteRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var found bool
+	err := api.store.UpdateExisting(vars["id"], func(data *UserData) {
+		rules := []MuteRule{}
+		for _, existing := range data.MuteRules {
+			if existing.ID == vars["ruleID"] {
+				found = true
+				continue
+			}
+			rules = append(rules, existing)
+		}
+		data.MuteRules = rules
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "mute rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *HandlersTestSuite) TestMuteMatcher() {
+	rules := []MuteRule{
+		{Type: muteSubreddit, Value: normalizeMuteValue(muteSubreddit, "/r/Politics")},
+		{Type: muteAuthor, Value: normalizeMuteValue(muteAuthor, "u/AutoModerator")},
+		{Type: muteDomain, Value: normalizeMuteValue(muteDomain, "www.example.com")},
+		{Type: muteKeyword, Value: "cat"},
+		{Type: muteKeyword, Value: "c++"},
+		{Type: muteRegex, Value: `^\[meta\]`},
+	}
+	m := newMuteMatcher(rules)
+
+	s.True(m.matches(RedditPost{Subreddit: "politics"}))
+	s.True(m.matches(RedditPost{Author: "AutoModerator"}))
+	s.True(m.matches(RedditPost{Domain: "news.example.com"}))
+	s.True(m.matches(RedditPost{Title: "My CAT is great"}))
+	s.True(m.matches(RedditPost{Title: "Learning C++ today"}))
+	s.True(m.matches(RedditPost{Title: "[Meta] rule changes"}))
+
+	// Crossposts should be muted for what they link to and where they were crossposted from
+	s.True(m.matches(RedditPost{Subreddit: "golang", Domain: "self.golang", CrosspostParentList: []RedditPost{{Subreddit: "golang", Domain: "example.com"}}}))
+	s.True(m.matches(RedditPost{Subreddit: "golang", Domain: "self.golang", CrosspostParentList: []RedditPost{{Subreddit: "Politics", Domain: "self.politics"}}}))
+	s.True(m.matches(RedditPost{Subreddit: "golang", Author: "gopher", CrosspostParentList: []RedditPost{{Subreddit: "golang", Author: "AutoModerator"}}}))
+	s.False(m.matches(RedditPost{Subreddit: "golang", Domain: "self.golang", CrosspostParentList: []RedditPost{{Subreddit: "rust", Domain: "blog.rust-lang.org"}}}))
+
+	// Partial words and unrelated domains should not match
+	s.False(m.matches(RedditPost{Title: "Education matters", Domain: "notexample.com", Subreddit: "golang"}))
+}
+
+func (s *HandlersTestSuite) TestMuteRuleEndpoints() {
+	// Invalid rules should be rejected
+	w := s.serveAPI(http.MethodPost, "/v1/muteuser/mutes", `{"type": "regex", "value": "("}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+	w = s.serveAPI(http.MethodPost, "/v1/muteuser/mutes", `{"type": "colour", "value": "red"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.serveAPI(http.MethodPost, "/v1/muteuser/mutes", `{"type": "subreddit", "value": "r/Pics"}`)
+	s.Equal(http.StatusCreated, w.Code)
+	rule := MuteRule{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &rule))
+	s.NotEmpty(rule.ID)
+	s.Equal("pics", rule.Value)
+
+	w = s.serveAPI(http.MethodPut, "/v1/muteuser/mutes/"+rule.ID, `{"type": "author", "value": "bot"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.serveAPI(http.MethodGet, "/v1/muteuser/mutes", "")
+	rules := []MuteRule{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &rules))
+	s.Equal([]MuteRule{{ID: rule.ID, Type: muteAuthor, Value: "bot"}}, rules)
+
+	w = s.serveAPI(http.MethodDelete, "/v1/muteuser/mutes/"+rule.ID, "")
+	s.Equal(http.StatusNoContent, w.Code)
+	w = s.serveAPI(http.MethodDelete, "/v1/muteuser/mutes/"+rule.ID, "")
+	s.Equal(http.StatusNotFound, w.Code)
+
+	// Rules of users we have never seen can't exist and looking for them shouldn't create the user
+	w = s.serveAPI(http.MethodPut, "/v1/unknownmuteuser/mutes/"+rule.ID, `{"type": "author", "value": "bot"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+	w = s.serveAPI(http.MethodDelete, "/v1/unknownmuteuser/mutes/"+rule.ID, "")
+	s.Equal(http.StatusNotFound, w.Code)
+	_, ok := s.handler.store.All()["unknownmuteuser"]
+	s.False(ok)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const linkRel = "noopener nofollow"
+
+// Elements we keep along with the attributes they are allowed to have
+var allowedElements = map[atom.Atom]map[string]bool{
+	atom.A:          {"href": true, "title": true},
+	atom.Abbr:       {"title": true},
+	atom.B:          {},
+	atom.Blockquote: {},
+	atom.Br:         {},
+	atom.Code:       {},
+	atom.Del:        {},
+	atom.Div:        {},
+	atom.Em:         {},
+	atom.H1:         {},
+	atom.H2:         {},
+	atom.H3:         {},
+	atom.H4:         {},
+	atom.H5:         {},
+	atom.H6:         {},
+	atom.Hr:         {},
+	atom.I:          {},
+	atom.Img:        {"src": true, "alt": true, "title": true, "width": true, "height": true},
+	atom.Li:         {},
+	atom.Ol:         {"start": true},
+	atom.P:          {},
+	atom.Pre:        {},
+	atom.S:          {},
+	atom.Span:       {},
+	atom.Strike:     {},
+	atom.Strong:     {},
+	atom.Sub:        {},
+	atom.Sup:        {},
+	atom.Table:      {},
+	atom.Tbody:      {},
+	atom.Td:         {"align": true, "colspan": true, "rowspan": true},
+	atom.Th:         {"align": true, "colspan": true, "rowspan": true},
+	atom.Thead:      {},
+	atom.Tr:         {},
+	atom.Ul:         {},
+}
+
+// Elements that are removed along with everything inside them, anything else that
+// isn't allowed is unwrapped so its text is kept
+var droppedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Form:     true,
+	atom.Input:    true,
+	atom.Button:   true,
+	atom.Textarea: true,
+	atom.Select:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Base:     true,
+}
+
+// Attributes that hold urls and must be checked before being kept
+var urlAttributes = map[string]bool{"href": true, "src": true}
+
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// Anything that isn't an allowed element or attribute is removed. Every element may keep its class
+// so that reddit styles such as spoilers still work
+func isAllowedAttr(a atom.Atom, key string) bool {
+	return key == "class" || allowedElements[a][key]
+}
+
+// Returns a safe version of the given url or false if it should be dropped. Relative links
+// are made absolute against reddit as that's where they are meant to point
+func sanitizeURL(raw string) (string, bool) {
+	// Browsers ignore whitespace and control characters in schemes so we must as well
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, raw)
+
+	u, err := url.Parse(cleaned)
+	if err != nil {
+		return "", false
+	}
+
+	if u.Scheme == "" {
+		if u.Host == "" && strings.HasPrefix(u.Path, "/") {
+			return "https://www.reddit.com" + u.String(), true
+		}
+		if u.Host != "" {
+			u.Scheme = "https"
+			return u.String(), true
+		}
+		// Fragments and other relative urls are harmless
+		return cleaned, true
+	}
+
+	if !allowedSchemes[strings.ToLower(u.Scheme)] {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// Sanitizes the element's attributes in place
+func sanitizeAttrs(n *html.Node) {
+	attrs := []html.Attribute{}
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		if a.Namespace != "" || !isAllowedAttr(n.DataAtom, key) {
+			continue
+		}
+		if urlAttributes[key] {
+			val, ok := sanitizeURL(a.Val)
+			if !ok {
+				continue
+			}
+			a.Val = val
+		}
+		attrs = append(attrs, html.Attribute{Key: key, Val: a.Val})
+	}
+
+	if n.DataAtom == atom.A {
+		attrs = append(attrs, html.Attribute{Key: "rel", Val: linkRel})
+	}
+	n.Attr = attrs
+}
+
+// Walks the children of n removing anything not on our allowlist
+func sanitizeNode(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+
+		switch c.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			if droppedElements[c.DataAtom] {
+				n.RemoveChild(c)
+			} else if _, ok := allowedElements[c.DataAtom]; ok {
+				sanitizeAttrs(c)
+				sanitizeNode(c)
+			} else {
+				// Unwrap the element and sanitize its children in its place
+				sanitizeNode(c)
+				for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+				}
+				n.RemoveChild(c)
+			}
+		default:
+			// Comments, doctypes etc. are never needed - this also removes reddit's SC_OFF/SC_ON markers
+			n.RemoveChild(c)
+		}
+
+		c = next
+	}
+}
+
+// Parses the given html and strips anything that could be used to run scripts in our frontend
+func sanitizeHTML(content string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		log.Printf("Unable to parse html content: %v", err)
+		return ""
+	}
+
+	// Attach the fragment to a root so the top level nodes can be sanitized like any others
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	sanitizeNode(root)
+
+	var buf bytes.Buffer
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			log.Printf("Unable to render html content: %v", err)
+			return ""
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,31 @@
+package handlers
+
+func (s *HandlersTestSuite) TestGetContentHTML() {
+	// Reddit's markers should be removed and the content unescaped
+	content := getContentHTML(`&lt;!-- SC_OFF --&gt;&lt;div class="md"&gt;&lt;p&gt;Hello &amp;amp; welcome&lt;/p&gt;&lt;/div&gt;&lt;!-- SC_ON --&gt;`)
+	s.Equal(`<div class="md"><p>Hello &amp; welcome</p></div>`, content)
+
+	// Content without the markers, or shorter than them, should not panic
+	s.Equal("short", getContentHTML("short"))
+	s.Equal("", getContentHTML("&lt;!-- SC_OFF --&gt;"))
+	s.Equal("", getContentHTML(""))
+}
+
+func (s *HandlersTestSuite) TestSanitizeHTML() {
+	// Scripts and other dangerous elements are removed entirely
+	s.Equal("<p>hi</p>", sanitizeHTML(`<p>hi</p><script>alert(1)</script><iframe src="https://evil.com"></iframe>`))
+
+	// Event handlers are stripped
+	s.Equal(`<img src="https://i.redd.it/a.png"/>`, sanitizeHTML(`<img src="https://i.redd.it/a.png" onerror="alert(1)">`))
+
+	// javascript urls are dropped, however they are disguised
+	s.Equal(`<a rel="noopener nofollow">x</a>`, sanitizeHTML(`<a href="javascript:alert(1)">x</a>`))
+	s.Equal(`<a rel="noopener nofollow">x</a>`, sanitizeHTML(`<a href=" JaVa&#x09;ScRiPt:alert(1)">x</a>`))
+
+	// Links get our rel and relative reddit links are made absolute
+	s.Equal(`<a href="https://example.com" rel="noopener nofollow">x</a>`, sanitizeHTML(`<a href="https://example.com" rel="opener" target="_blank">x</a>`))
+	s.Equal(`<a href="https://www.reddit.com/r/golang" rel="noopener nofollow">r/golang</a>`, sanitizeHTML(`<a href="/r/golang">r/golang</a>`))
+
+	// Unknown elements are unwrapped so their text is kept
+	s.Equal("<p>keep <b>me</b></p>", sanitizeHTML(`<p><custom onclick="x">keep <b>me</b></custom></p>`))
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+const storePermissions = 0600
+
+// Everything we keep on behalf of a single core user
+type UserData struct {
+	Filters   FilterSettings `json:"filters"`
+	MuteRules []MuteRule     `json:"muteRules,omitempty"`
+	Watches   []Watch        `json:"watches,omitempty"`
+	// The posts already delivered for each watch, keyed by watch id
+	WatchDeliveries map[string][]string `json:"watchDeliveries,omitempty"`
+}
+
+// Stores per user data keyed by the core user id. When given a path the data is saved
+// to disk after every change so it survives restarts, otherwise it is only kept in memory
+type userStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*UserData
+}
+
+func newUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, users: make(map[string]*UserData)}
+	if path == "" {
+		return s, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		log.Printf("Unable to read user data: %v", err)
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &s.users); err != nil {
+		log.Printf("Unable to parse user data: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns a copy of the data stored for the given user
+func (s *userStore) Get(userID string) UserData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if data, ok := s.users[userID]; ok {
+		return *data
+	}
+	return UserData{}
+}
+
+// Returns a copy of the data stored for every user
+func (s *userStore) All() map[string]UserData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make(map[string]UserData, len(s.users))
+	for userID, data := range s.users {
+		users[userID] = *data
+	}
+	return users
+}
+
+// Applies the given change to the users data and persists the result
+func (s *userStore) Update(userID string, update func(data *UserData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.users[userID]
+	if !ok {
+		data = &UserData{}
+		s.users[userID] = data
+	}
+	update(data)
+
+	return s.save()
+}
+
+// Applies the given change only if we already have data for the user, nothing is saved when we don't so
+// changes to things an unknown user can't have never create them
+func (s *userStore) UpdateExisting(userID string, update func(data *UserData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	update(data)
+
+	return s.save()
+}
+
+// Applies the given change to the data of each user we already know about and persists the result once,
+// so changing many users doesn't mean saving everything once for each of them
+func (s *userStore) UpdateUsers(userIDs []string, update func(userID string, data *UserData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, userID := range userIDs {
+		if data, ok := s.users[userID]; ok {
+			update(userID, data)
+		}
+	}
+
+	return s.save()
+}
+
+// Caller must hold the lock
+func (s *userStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	contents, err := json.Marshal(s.users)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave us with half written data
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, storePermissions); err != nil {
+		log.Printf("Unable to save user data: %v", err)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func (s *HandlersTestSuite) TestUserStore() {
+	dir, err := ioutil.TempDir("", "store")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	store, err := newUserStore(path)
+	s.Nil(err)
+	s.Equal(UserData{}, store.Get("user"))
+
+	s.Nil(store.Update("user", func(data *UserData) {
+		data.Filters.NSFW = filterShow
+	}))
+
+	// A new store using the same file should see the saved data
+	store, err = newUserStore(path)
+	s.Nil(err)
+	s.Equal(filterShow, store.Get("user").Filters.NSFW)
+
+	// Only users we already know about can be changed through UpdateExisting
+	s.Nil(store.UpdateExisting("unknown", func(data *UserData) {
+		data.Filters.NSFW = filterShow
+	}))
+	_, ok := store.All()["unknown"]
+	s.False(ok)
+
+	// Changes to several users are only applied to those we know about
+	s.Nil(store.UpdateUsers([]string{"user", "unknown"}, func(userID string, data *UserData) {
+		data.Filters.Spoilers = filterShow
+	}))
+	s.Equal(filterShow, store.Get("user").Filters.Spoilers)
+	_, ok = store.All()["unknown"]
+	s.False(ok)
+
+	// Corrupt data should be an error rather than silently dropped
+	s.Nil(ioutil.WriteFile(path, []byte("{"), storePermissions))
+	_, err = newUserStore(path)
+	s.NotNil(err)
+}
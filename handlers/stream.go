@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The quickest we poll a single set of subreddits
+	streamPollInterval = 15 * time.Second
+	// Requests per minute every poller shares, this keeps us well inside Reddit's limits however many sets are watched
+	streamRequestBudget = 30
+	// Pollers keep running for a while after their last subscriber leaves so clients can reconnect and resume
+	streamIdleTimeout = 2 * time.Minute
+	streamMaxBackoff  = 5 * time.Minute
+	streamHeartbeat   = 25 * time.Second
+	// Recent events kept for clients resuming with Last-Event-ID
+	maxStreamBuffer = 200
+	// Events queued for a subscriber before we decide it can't keep up and drop it
+	streamQueueSize = 64
+)
+
+// A post that appeared in a polled listing, the id is the post's fullname
+type streamEvent struct {
+	ID   string
+	Post RedditPost
+}
+
+// Shares upstream polls between everyone streaming the same set of subreddits
+type streamHub struct {
+	mu      sync.Mutex
+	pollers map[string]*streamPoller
+	// Closed when we are shutting down to end every open stream
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Requests the watches make each time they poll, they come out of the same budget as the pollers
+	watchRequests int
+
+	// Fetches a page of a listing on behalf of the app rather than any one user
+	fetch        func(l listing, query string) (*RedditResponse, error)
+	pollInterval time.Duration
+	budget       int
+	idleTimeout  time.Duration
+}
+
+// Polls the new listing of a set of subreddits and passes new posts to its subscribers
+type streamPoller struct {
+	hub *streamHub
+	key string
+
+	mu          sync.Mutex
+	subscribers map[chan streamEvent]bool
+	buffer      []streamEvent
+	idle        *time.Timer
+	stop        chan struct{}
+}
+
+func newStreamHub(fetch func(l listing, query string) (*RedditResponse, error)) *streamHub {
+	return &streamHub{
+		pollers:      map[string]*streamPoller{},
+		closing:      make(chan struct{}),
+		fetch:        fetch,
+		pollInterval: streamPollInterval,
+		budget:       streamRequestBudget,
+		idleTimeout:  streamIdleTimeout,
+	}
+}
+
+// Gets the key shared by every subscriber of the same subreddits, whatever order they were asked for in
+func streamKey(subreddits []string) string {
+	key := make([]string, len(subreddits))
+	for i, sub := range subreddits {
+		key[i] = strings.ToLower(sub)
+	}
+	sort.Strings(key)
+	return strings.Join(key, "+")
+}
+
+// How long to wait between requests so every request we poll with fits in the budget, but no less than min.
+// The budget is split between every active poller and each request the watches make so adding more of
+// either slows them all down rather than getting us rate limited
+func (h *streamHub) shareDelay(min time.Duration) time.Duration {
+	h.mu.Lock()
+	shares := len(h.pollers) + h.watchRequests
+	h.mu.Unlock()
+
+	delay := time.Minute * time.Duration(shares) / time.Duration(h.budget)
+	if delay < min {
+		delay = min
+	}
+	return delay
+}
+
+// How long each poller waits between polls
+func (h *streamHub) pollDelay() time.Duration {
+	return h.shareDelay(h.pollInterval)
+}
+
+// Records how many requests the watches made in their last poll and returns how long they should wait
+// before polling again
+func (h *streamHub) watchDelay(requests int) time.Duration {
+	h.mu.Lock()
+	h.watchRequests = requests
+	h.mu.Unlock()
+
+	return h.shareDelay(watchPollInterval)
+}
+
+// Subscribes to the given subreddits, starting a poller if nobody else is already watching them.
+// Returns the channel events are sent on and any buffered events that came after lastEventID
+func (h *streamHub) subscribe(key, lastEventID string) (*streamPoller, chan streamEvent, []streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, ok := h.pollers[key]
+	if !ok {
+		p = &streamPoller{hub: h, key: key, subscribers: map[chan streamEvent]bool{}, stop: make(chan struct{})}
+		h.pollers[key] = p
+		go p.run()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.idle != nil {
+		p.idle.Stop()
+		p.idle = nil
+	}
+
+	ch := make(chan streamEvent, streamQueueSize)
+	p.subscribers[ch] = true
+
+	var replay []streamEvent
+	if lastEventID != "" {
+		// If we no longer have the event the client saw last we send everything we have, a few
+		// duplicates are better than missing posts
+		replay = append(replay, p.buffer...)
+		for i, e := range p.buffer {
+			if e.ID == lastEventID {
+				replay = append([]streamEvent{}, p.buffer[i+1:]...)
+				break
+			}
+		}
+	}
+	return p, ch, replay
+}
+
+// Removes the subscriber, the poller is stopped once it has been idle for long enough
+func (h *streamHub) unsubscribe(p *streamPoller, ch chan streamEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.subscribers, ch)
+	if len(p.subscribers) == 0 && p.idle == nil {
+		p.idle = time.AfterFunc(h.idleTimeout, func() { h.remove(p) })
+	}
+}
+
+func (h *streamHub) remove(p *streamPoller) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Someone may have subscribed while we were waiting for the locks
+	if len(p.subscribers) > 0 || h.pollers[p.key] != p {
+		return
+	}
+	delete(h.pollers, p.key)
+	close(p.stop)
+}
+
+// Ends every open stream, clients can resume from their last event once we are back
+func (h *streamHub) close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+// Buffers the events and sends them to every subscriber
+func (p *streamPoller) broadcast(events []streamEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buffer = append(p.buffer, events...)
+	if len(p.buffer) > maxStreamBuffer {
+		p.buffer = append([]streamEvent{}, p.buffer[len(p.buffer)-maxStreamBuffer:]...)
+	}
+
+	for ch := range p.subscribers {
+		for _, e := range events {
+			select {
+			case ch <- e:
+			default:
+				// The subscriber isn't keeping up, closing the channel ends their stream so they can resume
+				log.Printf("Dropping slow stream subscriber for %v", p.key)
+				delete(p.subscribers, ch)
+				close(ch)
+			}
+			if !p.subscribers[ch] {
+				break
+			}
+		}
+	}
+}
+
+func (p *streamPoller) run() {
+	l := listing{Type: listingSubreddit, Subreddit: p.key, Sort: "new"}
+	query := l.query("", "", 0, maxListingLimit)
+
+	// Only posts made after the newest one we know of are new. Posts dropping out of the listing pull older
+	// ones into it so what was in the last listing isn't enough to go on. The first poll only tells us
+	// where to start from
+	started := false
+	var newest float64
+	// Posts made at exactly the newest time that have already been sent
+	atNewest := map[string]bool{}
+	var backoff time.Duration
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		vals, err := p.hub.fetch(l, query)
+		if err != nil {
+			if backoff *= 2; backoff == 0 {
+				backoff = p.hub.pollInterval
+			} else if backoff > streamMaxBackoff {
+				backoff = streamMaxBackoff
+			}
+			log.Printf("Unable to poll %v, retrying in %v: %v", p.key, backoff, err)
+			wait = backoff
+			continue
+		}
+		backoff = 0
+		wait = p.hub.pollDelay()
+
+		events := []streamEvent{}
+		// Listings are newest first but clients should get posts in the order they were made
+		for i := len(vals.Data.Children) - 1; i >= 0; i-- {
+			post := vals.Data.Children[i].Data
+			if post.UnixTime < newest || (post.UnixTime == newest && atNewest[post.ID]) {
+				continue
+			}
+			if post.UnixTime > newest {
+				newest = post.UnixTime
+				atNewest = map[string]bool{}
+			}
+			atNewest[post.ID] = true
+			if started {
+				events = append(events, streamEvent{ID: linkPrefix + post.ID, Post: post})
+			}
+		}
+		started = true
+
+		if len(events) > 0 {
+			p.broadcast(events)
+		}
+	}
+}
+
+// Streams new posts from the given subreddits as server sent events
+// GET /v1/{id}/stream
+func (api *CoreHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	id := mux.Vars(r)["id"]
+
+	opts, err := getPostOptions(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subreddits, err := parseSubreddits(queryParams.Get("subreddits"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts.filters = api.resolveFilters(opts.filters, id, redditAuth)
+	muted := newMuteMatcher(api.store.Get(id).MuteRules)
+
+	poller, events, replay := api.streams.subscribe(streamKey(subreddits), r.Header.Get("Last-Event-ID"))
+	defer api.streams.unsubscribe(poller, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e streamEvent) {
+		var data []byte
+		if post, ok := newPost(e.Post, opts); ok && !muted.matches(e.Post) {
+			if data, err = json.Marshal(post); err != nil {
+				log.Printf("Unable to marshall stream event: %v", err)
+				data = nil
+			}
+		}
+
+		if data == nil {
+			// Posts the user doesn't want still move their last event id on so a resume doesn't start behind them
+			fmt.Fprintf(w, "id: %v\n\n", e.ID)
+		} else {
+			fmt.Fprintf(w, "id: %v\nevent: post\ndata: %s\n\n", e.ID, data)
+		}
+		flusher.Flush()
+	}
+
+	for _, e := range replay {
+		send(e)
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-api.streams.closing:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			send(e)
+		case <-heartbeat.C:
+			// Comments keep proxies from closing the connection while nothing is happening
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// Ends every open stream so shutting down doesn't have to wait for clients to leave
+func (api *CoreHandler) CloseStreams() {
+	api.streams.close()
+}
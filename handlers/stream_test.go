@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves a new listing that gains a post every time it is polled
+type fakeNewListing struct {
+	mu    sync.Mutex
+	polls int
+	paths []string
+}
+
+func (f *fakeNewListing) fetch(l listing, query string) (*RedditResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, l.path())
+
+	resp := &RedditResponse{}
+	for i := f.polls; i >= 0; i-- {
+		child := struct {
+			Data RedditPost `json:"data"`
+		}{RedditPost{ID: "n" + string('a'+rune(i)), Title: "New post", UnixTime: float64(1500000000 + i)}}
+		resp.Data.Children = append(resp.Data.Children, child)
+	}
+	f.polls++
+	return resp, nil
+}
+
+// Reads events from the stream until it has count of them
+func readStreamEvents(reader *bufio.Reader, count int) []string {
+	ids := []string{}
+	for len(ids) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+	return ids
+}
+
+func (s *HandlersTestSuite) TestStreamKey() {
+	s.Equal("golang+rust", streamKey([]string{"Rust", "golang"}))
+	s.Equal(streamKey([]string{"a", "b"}), streamKey([]string{"B", "A"}))
+}
+
+func (s *HandlersTestSuite) TestStream() {
+	fake := &fakeNewListing{}
+	s.handler.streams = newStreamHub(fake.fetch)
+	s.handler.streams.pollInterval = 10 * time.Millisecond
+	s.handler.streams.budget = 60000
+	s.handler.streams.idleTimeout = time.Second
+
+	server := httptest.NewServer(s.api)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/user/stream?subreddits=Rust,golang")
+	s.Nil(err)
+	s.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	// The posts there when we started aren't new, everything after them should be sent oldest first
+	ids := readStreamEvents(bufio.NewReader(resp.Body), 2)
+	resp.Body.Close()
+	s.Equal([]string{"t3_nb", "t3_nc"}, ids)
+
+	fake.mu.Lock()
+	s.Equal("/r/golang+rust/new", fake.paths[0])
+	fake.mu.Unlock()
+
+	// Reconnecting should replay what was missed since the last event and share the existing poller
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/user/stream?subreddits=golang,rust", nil)
+	req.Header.Set("Last-Event-ID", "t3_nb")
+	resp, err = http.DefaultClient.Do(req)
+	s.Nil(err)
+	ids = readStreamEvents(bufio.NewReader(resp.Body), 1)
+	resp.Body.Close()
+	s.Equal([]string{"t3_nc"}, ids)
+
+	s.handler.streams.mu.Lock()
+	s.Len(s.handler.streams.pollers, 1)
+	s.handler.streams.mu.Unlock()
+
+	w := s.serveAPI(http.MethodGet, "/v1/user/stream?subreddits=../api", "")
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestStreamOnlySendsNewerPosts() {
+	// Each poll returns the next listing, posts dropping out of it pull older ones into view
+	listings := [][]RedditPost{
+		{{ID: "c", UnixTime: 300}, {ID: "b", UnixTime: 200}},
+		{{ID: "d", UnixTime: 400}, {ID: "c", UnixTime: 300}, {ID: "a", UnixTime: 100}},
+		{{ID: "f", UnixTime: 400}, {ID: "d", UnixTime: 400}, {ID: "a", UnixTime: 100}},
+	}
+	var mu sync.Mutex
+	polls := 0
+	hub := newStreamHub(func(l listing, query string) (*RedditResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp := &RedditResponse{}
+		for _, post := range listings[polls] {
+			child := struct {
+				Data RedditPost `json:"data"`
+			}{post}
+			resp.Data.Children = append(resp.Data.Children, child)
+		}
+		if polls < len(listings)-1 {
+			polls++
+		}
+		return resp, nil
+	})
+	hub.pollInterval = 10 * time.Millisecond
+	hub.budget = 60000
+	hub.idleTimeout = time.Second
+
+	poller, events, _ := hub.subscribe("golang", "")
+	defer hub.unsubscribe(poller, events)
+
+	ids := []string{}
+	for len(ids) < 2 {
+		select {
+		case e := <-events:
+			ids = append(ids, e.ID)
+		case <-time.After(time.Second):
+			s.FailNow("timed out waiting for stream events")
+		}
+	}
+	s.Equal([]string{"t3_d", "t3_f"}, ids)
+
+	// Nothing else is newer so nothing else should be sent
+	select {
+	case e := <-events:
+		s.Fail("unexpected stream event", e.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *HandlersTestSuite) TestCloseStreams() {
+	s.handler.streams = newStreamHub((&fakeNewListing{}).fetch)
+	server := httptest.NewServer(s.api)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/user/stream?subreddits=golang")
+	s.Nil(err)
+	defer resp.Body.Close()
+
+	// Closing should end the stream rather than leaving it open until the client goes away
+	ended := make(chan struct{})
+	go func(body io.Reader) {
+		ioutil.ReadAll(body)
+		close(ended)
+	}(resp.Body)
+	s.handler.CloseStreams()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		s.Fail("stream was not closed")
+	}
+
+	// Streams opened once we are closing should end straight away
+	resp, err = http.Get(server.URL + "/v1/user/stream?subreddits=golang")
+	s.Nil(err)
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	s.Nil(err)
+}
+
+func (s *HandlersTestSuite) TestStreamPollDelay() {
+	hub := newStreamHub(nil)
+	s.Equal(streamPollInterval, hub.pollDelay())
+
+	// The request budget is shared so every poller slows down as more sets are watched
+	for i := 0; i < streamRequestBudget; i++ {
+		hub.pollers[string('a'+rune(i))] = &streamPoller{}
+	}
+	s.Equal(time.Minute, hub.pollDelay())
+
+	// Watches take their requests out of the same budget so everyone slows down to make room for them
+	s.Equal(2*time.Minute, hub.watchDelay(streamRequestBudget))
+	s.Equal(2*time.Minute, hub.pollDelay())
+	s.Equal(watchPollInterval, newStreamHub(nil).watchDelay(1))
+}
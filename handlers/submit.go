@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	submitEndpoint  = "/api/submit"
+	commentEndpoint = "/api/comment"
+
+	// Error codes returned by Reddit in json.errors that we handle specially
+	errRateLimit        = "RATELIMIT"
+	errBadCaptcha       = "BAD_CAPTCHA"
+	errSubredditNoExist = "SUBREDDIT_NOEXIST"
+)
+
+// Replies can only be made to comments (t1) and posts (t3)
+var replyFullnamePattern = regexp.MustCompile(`^t[13]_[a-z0-9]+$`)
+
+// Matches the wait time in Reddit's rate limit messages e.g. "try again in 9 minutes."
+var retryAfterRegex = regexp.MustCompile(`try again in (\d+) (second|minute|hour)`)
+
+// Body of a request to submit a new post to a subreddit
+type SubmitRequest struct {
+	AuthRequest
+	// Either "link" or "self"
+	Kind        string `json:"kind"`
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Text        string `json:"text"`
+	Resubmit    bool   `json:"resubmit"`
+	SendReplies bool   `json:"send-replies"`
+}
+
+// Body of a request to reply to a post or comment
+type ReplyRequest struct {
+	AuthRequest
+	Text string `json:"text"`
+}
+
+// A single error from Reddit's json.errors mapped into something our clients can act on
+type RedditAPIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	// Number of seconds until the request can be retried, only set for rate limit errors
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+type RedditAPIErrors []RedditAPIError
+
+func (e RedditAPIErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Code + ": " + err.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// The status code we should respond with for these errors
+func (e RedditAPIErrors) StatusCode() int {
+	for _, err := range e {
+		switch err.Code {
+		case errRateLimit:
+			return http.StatusTooManyRequests
+		case errSubredditNoExist:
+			return http.StatusNotFound
+		case errBadCaptcha:
+			return http.StatusForbidden
+		}
+	}
+	return http.StatusBadRequest
+}
+
+// Longest wait time of any rate limit errors
+func (e RedditAPIErrors) RetryAfter() int {
+	var retryAfter int
+	for _, err := range e {
+		if err.RetryAfter > retryAfter {
+			retryAfter = err.RetryAfter
+		}
+	}
+	return retryAfter
+}
+
+// Struct for the response from reddit for endpoints called with api_type=json
+type RedditJSONResponse struct {
+	JSON struct {
+		// Each error is an array of [code, message, field]
+		Errors [][]string `json:"errors"`
+		Data   struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			URL    string `json:"url"`
+			Things []struct {
+				Data struct {
+					ID        string `json:"id"`
+					Name      string `json:"name"`
+					Permalink string `json:"permalink"`
+				} `json:"data"`
+			} `json:"things"`
+		} `json:"data"`
+	} `json:"json"`
+}
+
+// Response we send after successfully creating a post or comment
+type CreatedResponse struct {
+	ID       string `json:"id"`
+	Fullname string `json:"fullname"`
+	URL      string `json:"url"`
+}
+
+// Parses the number of seconds to wait from a Reddit rate limit message
+func parseRetryAfter(message string) int {
+	match := retryAfterRegex.FindStringSubmatch(message)
+	if match == nil {
+		return 0
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+
+	switch match[2] {
+	case "minute":
+		return n * 60
+	case "hour":
+		return n * 60 * 60
+	}
+	return n
+}
+
+// Converts the errors in a Reddit json response into structured errors, returns nil if there are none
+func parseRedditErrors(errs [][]string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	apiErrs := make(RedditAPIErrors, 0, len(errs))
+	for _, e := range errs {
+		apiErr := RedditAPIError{}
+		if len(e) > 0 {
+			apiErr.Code = e[0]
+		}
+		if len(e) > 1 {
+			apiErr.Message = e[1]
+		}
+		if len(e) > 2 {
+			apiErr.Field = e[2]
+		}
+		if apiErr.Code == errRateLimit {
+			apiErr.RetryAfter = parseRetryAfter(apiErr.Message)
+		}
+		apiErrs = append(apiErrs, apiErr)
+	}
+
+	return apiErrs
+}
+
+// Writes the given error to the response, structured Reddit errors are sent back as json. Unauthorized, not
+// found, forbidden and rate limited statuses are passed on so clients can tell them apart from us failing
+func writeRedditError(w http.ResponseWriter, err error) {
+	if statusErr, ok := err.(*redditStatusError); ok {
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusNotFound, http.StatusForbidden, http.StatusTooManyRequests:
+			http.Error(w, statusErr.Error(), statusErr.StatusCode)
+			return
+		}
+	}
+
+	apiErrs, ok := err.(RedditAPIErrors)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(struct {
+		Errors RedditAPIErrors `json:"errors"`
+	}{apiErrs})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if retryAfter := apiErrs.RetryAfter(); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErrs.StatusCode())
+	w.Write(res)
+}
+
+// Posts the form to a Reddit endpoint that supports api_type=json and parses the response
+func (api *CoreHandler) postRedditJSON(auth *AuthRequest, userID, endpoint string, form url.Values) (*RedditJSONResponse, error) {
+	form.Set("api_type", "json")
+
+	body, err := api.postRedditForm(auth, userID, endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := &RedditJSONResponse{}
+	if err := json.Unmarshal(body, vals); err != nil {
+		log.Printf("Unable to unmarshall response: %v\n", err)
+		return nil, err
+	}
+
+	if err := parseRedditErrors(vals.JSON.Errors); err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+func writeCreated(w http.ResponseWriter, created CreatedResponse) {
+	res, err := json.Marshal(created)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(res)
+}
+
+// Submits a link or self post to the given subreddit
+// POST /v1/{id}/subreddits/{name}/submit
+func (api *CoreHandler) Submit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	submit := &SubmitRequest{}
+	if err := json.Unmarshal(body, submit); err != nil {
+		log.Printf("Received invalid submit request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("sr", vars["name"])
+	form.Set("title", submit.Title)
+	form.Set("resubmit", strconv.FormatBool(submit.Resubmit))
+	form.Set("sendreplies", strconv.FormatBool(submit.SendReplies))
+
+	switch submit.Kind {
+	case "link":
+		if submit.URL == "" {
+			http.Error(w, "link posts require a url", http.StatusBadRequest)
+			return
+		}
+		form.Set("url", submit.URL)
+	case "self":
+		form.Set("text", submit.Text)
+	default:
+		http.Error(w, fmt.Sprintf("invalid post kind: %q", submit.Kind), http.StatusBadRequest)
+		return
+	}
+	form.Set("kind", submit.Kind)
+
+	resp, err := api.postRedditJSON(&submit.AuthRequest, vars["id"], submitEndpoint, form)
+	if err != nil {
+		log.Printf("Unable to submit post to %v: %v", vars["name"], err)
+		writeRedditError(w, err)
+		return
+	}
+
+	data := resp.JSON.Data
+	writeCreated(w, CreatedResponse{ID: data.ID, Fullname: data.Name, URL: data.URL})
+}
+
+// Replies to the post or comment with the given fullname
+// POST /v1/{id}/things/{fullname}/reply
+func (api *CoreHandler) Reply(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !replyFullnamePattern.MatchString(vars["fullname"]) {
+		http.Error(w, "replies can only be made to posts and comments", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reply := &ReplyRequest{}
+	if err := json.Unmarshal(body, reply); err != nil {
+		log.Printf("Received invalid reply request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if reply.Text == "" {
+		http.Error(w, "replies require text", http.StatusBadRequest)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("thing_id", vars["fullname"])
+	form.Set("text", reply.Text)
+
+	resp, err := api.postRedditJSON(&reply.AuthRequest, vars["id"], commentEndpoint, form)
+	if err != nil {
+		log.Printf("Unable to reply to %v: %v", vars["fullname"], err)
+		writeRedditError(w, err)
+		return
+	}
+
+	created := CreatedResponse{}
+	if things := resp.JSON.Data.Things; len(things) > 0 {
+		comment := things[0].Data
+		created = CreatedResponse{ID: comment.ID, Fullname: comment.Name}
+		if comment.Permalink != "" {
+			created.URL = "https://reddit.com" + comment.Permalink
+		}
+	}
+	writeCreated(w, created)
+}
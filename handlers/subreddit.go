@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+// About pages change rarely and every user sees the same thing so we can hold on to them for a while
+const subredditTTL = 12 * time.Hour
+
+// The lists of subreddits Reddit offers, default is what new accounts are subscribed to
+var subredditLists = map[string]bool{"default": true, "popular": true, "new": true}
+
+type RedditSubreddit struct {
+	Name                  string  `json:"display_name"`
+	Title                 string  `json:"title"`
+	PublicDescription     string  `json:"public_description_html"`
+	Description           string  `json:"description_html"`
+	IconImg               string  `json:"icon_img"`
+	CommunityIcon         string  `json:"community_icon"`
+	BannerImg             string  `json:"banner_img"`
+	BannerBackgroundImage string  `json:"banner_background_image"`
+	PrimaryColor          string  `json:"primary_color"`
+	KeyColor              string  `json:"key_color"`
+	Subscribers           int     `json:"subscribers"`
+	ActiveUsers           int     `json:"active_user_count"`
+	Over18                bool    `json:"over18"`
+	Quarantine            bool    `json:"quarantine"`
+	SubmissionType        string  `json:"submission_type"`
+	SubredditType         string  `json:"subreddit_type"`
+	UnixTime              float64 `json:"created_utc"`
+	RelativePath          string  `json:"url"`
+}
+
+type RedditSubredditAbout struct {
+	Kind string          `json:"kind"`
+	Data RedditSubreddit `json:"data"`
+}
+
+type RedditSubredditListing struct {
+	Data struct {
+		Children []RedditSubredditAbout `json:"children"`
+	} `json:"data"`
+}
+
+type RedditRule struct {
+	Kind            string `json:"kind"`
+	ShortName       string `json:"short_name"`
+	Description     string `json:"description_html"`
+	ViolationReason string `json:"violation_reason"`
+	Priority        int    `json:"priority"`
+}
+
+type RedditRules struct {
+	Rules []RedditRule `json:"rules"`
+}
+
+type SubredditList struct {
+	Subreddits []Subreddit `json:"subreddits"`
+}
+
+type SubredditRule struct {
+	// One of link, comment or all
+	Kind            string `json:"kind"`
+	Name            string `json:"name"`
+	Description     string `json:"description,omitempty"`
+	ViolationReason string `json:"violationReason,omitempty"`
+}
+
+type Subreddit struct {
+	Name              string `json:"name"`
+	Title             string `json:"title"`
+	PublicDescription string `json:"publicDescription,omitempty"`
+	Description       string `json:"description,omitempty"`
+	Icon              string `json:"icon,omitempty"`
+	Banner            string `json:"banner,omitempty"`
+	PrimaryColor      string `json:"primaryColor,omitempty"`
+	Subscribers       int    `json:"subscribers"`
+	ActiveUsers       int    `json:"activeUsers"`
+	NSFW              bool   `json:"nsfw"`
+	Quarantined       bool   `json:"quarantined"`
+	// One of any, link or self
+	SubmissionType string `json:"submissionType"`
+	// One of public, restricted, private and so on
+	Type    string          `json:"type"`
+	Created time.Time       `json:"created"`
+	Link    string          `json:"link"`
+	Rules   []SubredditRule `json:"rules"`
+}
+
+// Reddit has moved subreddit images around over time, we prefer the newer fields when a subreddit has set them
+func firstImage(candidates ...string) string {
+	for _, candidate := range candidates {
+		if image := getThumbnail(candidate); image != "" {
+			return image
+		}
+	}
+	return ""
+}
+
+// Maps the about page and rules from Reddit into our subreddit, descriptions are sanitized html
+func newSubreddit(about RedditSubreddit, rules []RedditRule) *Subreddit {
+	primaryColor := about.PrimaryColor
+	if primaryColor == "" {
+		primaryColor = about.KeyColor
+	}
+
+	subreddit := &Subreddit{
+		Name:              about.Name,
+		Title:             html.UnescapeString(about.Title),
+		PublicDescription: getContentHTML(about.PublicDescription),
+		Description:       getContentHTML(about.Description),
+		Icon:              firstImage(about.CommunityIcon, about.IconImg),
+		Banner:            firstImage(about.BannerBackgroundImage, about.BannerImg),
+		PrimaryColor:      primaryColor,
+		Subscribers:       about.Subscribers,
+		ActiveUsers:       about.ActiveUsers,
+		NSFW:              about.Over18,
+		Quarantined:       about.Quarantine,
+		SubmissionType:    about.SubmissionType,
+		Type:              about.SubredditType,
+		Created:           redditTime(about.UnixTime),
+		Link:              redditBaseURL + about.RelativePath,
+		Rules:             []SubredditRule{},
+	}
+
+	for _, rule := range rules {
+		subreddit.Rules = append(subreddit.Rules, SubredditRule{
+			Kind:            rule.Kind,
+			Name:            html.UnescapeString(rule.ShortName),
+			Description:     getContentHTML(rule.Description),
+			ViolationReason: html.UnescapeString(rule.ViolationReason),
+		})
+	}
+	return subreddit
+}
+
+// Gets a subreddit's about page and rules, public subreddits are cached for everyone
+func (api *CoreHandler) getSubreddit(auth *AuthRequest, userID, name string) (*Subreddit, error) {
+	key := strings.ToLower(name)
+	if subreddit, ok := api.subreddits.Get(key); ok {
+		return subreddit.(*Subreddit), nil
+	}
+
+	about := &RedditSubredditAbout{}
+	if err := api.getRedditJSON(auth, userID, "/r/"+name+"/about", "", about); err != nil {
+		return nil, err
+	} else if about.Kind != "t5" {
+		// Reddit sends search results instead of a 404 for some subreddits that don't exist
+		return nil, &redditStatusError{StatusCode: http.StatusNotFound}
+	}
+
+	// Rules are nice to have, a subreddit is still worth showing without them
+	rules := &RedditRules{}
+	rulesErr := api.getRedditJSON(auth, userID, "/r/"+name+"/about/rules", "", rules)
+	if rulesErr != nil {
+		log.Printf("Unable to get rules for r/%v: %v", name, rulesErr)
+	}
+
+	subreddit := newSubreddit(about.Data, rules.Rules)
+	// Private and quarantined subreddits are only visible to some users so they can't be shared with everyone
+	if rulesErr == nil && subreddit.Type != "private" && !subreddit.Quarantined {
+		api.subreddits.Set(key, subreddit)
+	}
+	return subreddit, nil
+}
+
+// Gets the details of a subreddit
+// GET /v1/subreddits/{name}
+func (api *CoreHandler) GetSubreddit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	name := strings.TrimPrefix(vars["name"], "r/")
+	if !subredditPattern.MatchString(name) || strings.Contains(name, "+") {
+		http.Error(w, "invalid subreddit name", http.StatusBadRequest)
+		return
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	subreddit, err := api.getSubreddit(redditAuth, vars["id"], name)
+	if err != nil {
+		log.Printf("Unable to get r/%v: %v", name, err)
+		writeRedditError(w, err)
+		return
+	}
+
+	res, err := json.Marshal(subreddit)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Gets one of Reddit's lists of subreddits, rules are left out to keep the list to a single request
+// GET /v1/subreddits
+func (api *CoreHandler) GetSubreddits(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	where := queryParams.Get("where")
+	if where == "" {
+		where = "default"
+	}
+	if !subredditLists[where] {
+		http.Error(w, "where must be one of default, popular or new", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultListingLimit
+	if param := queryParams.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxListingLimit {
+			http.Error(w, fmt.Sprintf("limit must be an integer between 1 and %v", maxListingLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vals := &RedditSubredditListing{}
+	query := "?" + url.Values{"limit": {strconv.Itoa(limit)}}.Encode()
+	if err := api.getRedditJSON(redditAuth, mux.Vars(r)["id"], "/subreddits/"+where, query, vals); err != nil {
+		log.Printf("Unable to get %v subreddits: %v", where, err)
+		writeRedditError(w, err)
+		return
+	}
+
+	list := SubredditList{Subreddits: []Subreddit{}}
+	for _, c := range vals.Data.Children {
+		list.Subreddits = append(list.Subreddits, *newSubreddit(c.Data, nil))
+	}
+
+	res, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
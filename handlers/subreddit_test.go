@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *HandlersTestSuite) TestGetSubreddit() {
+	s.aboutRequests = 0
+	w := s.serveAPI(http.MethodGet, "/v1/subreddits/Gophers", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	subreddit := Subreddit{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &subreddit))
+	s.Equal("Gophers", subreddit.Name)
+	s.Equal("Gophers & friends", subreddit.Title)
+	s.Equal("<p>All about Go</p>", subreddit.PublicDescription)
+	s.Equal("https://styles.redditmedia.com/icon.png?width=256&s=abc", subreddit.Icon)
+	s.Equal("https://b.thumbs.redditmedia.com/banner.png", subreddit.Banner)
+	s.Equal("#00add8", subreddit.PrimaryColor)
+	s.Equal(200000, subreddit.Subscribers)
+	s.Equal(300, subreddit.ActiveUsers)
+	s.Equal("https://www.reddit.com/r/Gophers/", subreddit.Link)
+	s.Len(subreddit.Rules, 1)
+	s.Equal("Be nice", subreddit.Rules[0].Name)
+	s.Equal("<p>No trolling</p>", subreddit.Rules[0].Description)
+
+	// Subreddits should be cached whatever case they are asked for in
+	w = s.serveAPI(http.MethodGet, "/v1/subreddits/gophers", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal(1, s.aboutRequests)
+}
+
+func (s *HandlersTestSuite) TestGetSubredditErrors() {
+	w := s.serveAPI(http.MethodGet, "/v1/subreddits/private", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusForbidden, w.Code)
+	s.Contains(w.Body.String(), "private")
+
+	w = s.serveAPI(http.MethodGet, "/v1/subreddits/missing", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+
+	w = s.serveAPI(http.MethodGet, "/v1/subreddits/golang+rust", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetSubreddits() {
+	w := s.serveAPI(http.MethodGet, "/v1/subreddits?limit=2", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("/subreddits/default", s.lastListing.Path)
+	s.Equal("2", s.lastListing.Query().Get("limit"))
+
+	list := SubredditList{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &list))
+	s.Len(list.Subreddits, 2)
+	s.Equal("pics", list.Subreddits[0].Name)
+	s.Equal(30000000, list.Subreddits[0].Subscribers)
+
+	w = s.serveAPI(http.MethodGet, "/v1/subreddits?where=mine", "")
+	s.Equal(http.StatusBadRequest, w.Code)
+}
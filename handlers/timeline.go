@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	listingTimeline = "timeline"
+
+	rankRecency      = "recency"
+	rankScore        = "score"
+	rankScorePerHour = "score_per_hour"
+	rankHot          = "hot"
+
+	maxTimelineSources = 20
+	// Reddit measures hot from this point in time, see reddit's _sorts.pyx
+	hotEpoch = 1134028003
+)
+
+// The Reddit sort each source is fetched with, a source must already be close to our ranking so
+// that taking posts from the front of each one gives a sensible merge. Reddit has no sort close to score
+// per hour so those sources are fetched newest first and every post fetched is ranked instead
+var rankSorts = map[string]string{
+	rankRecency:      "new",
+	rankScore:        "top",
+	rankScorePerHour: "new",
+	rankHot:          "hot",
+}
+
+// Where a single subreddit is up to within a merged timeline
+type sourceCursor struct {
+	Subreddit string `json:"r"`
+	After     string `json:"a,omitempty"`
+	Count     int    `json:"c,omitempty"`
+	// Set once the subreddit has no more posts
+	Done bool `json:"d,omitempty"`
+}
+
+// The posts fetched from one source for the current page
+type sourceBatch struct {
+	posts []RedditPost
+	after string
+	err   error
+}
+
+// Parses a comma separated list of subreddits, duplicates are removed
+func parseSubreddits(param string) ([]string, error) {
+	subreddits := []string{}
+	seen := map[string]bool{}
+	for _, sub := range strings.Split(param, ",") {
+		sub = strings.TrimPrefix(strings.TrimSpace(sub), "r/")
+		if sub == "" || seen[strings.ToLower(sub)] {
+			continue
+		}
+		if !subredditPattern.MatchString(sub) || strings.Contains(sub, "+") {
+			return nil, fmt.Errorf("invalid subreddit name: %v", sub)
+		}
+		seen[strings.ToLower(sub)] = true
+		subreddits = append(subreddits, sub)
+	}
+	if len(subreddits) == 0 || len(subreddits) > maxTimelineSources {
+		return nil, fmt.Errorf("subreddits must list between 1 and %v subreddits", maxTimelineSources)
+	}
+	return subreddits, nil
+}
+
+// Gets the timeline requested through the subreddits, rank and t params
+func getTimeline(queryParams url.Values) (listing, string, []sourceCursor, error) {
+	rank := queryParams.Get("rank")
+	if rank == "" {
+		rank = rankHot
+	}
+	sort, ok := rankSorts[rank]
+	if !ok {
+		return listing{}, "", nil, fmt.Errorf("rank must be one of recency, score, score_per_hour or hot")
+	}
+
+	l := listing{Type: listingTimeline, Sort: sort, Time: queryParams.Get("t")}
+	if l.Time != "" && !listingTimes[l.Time] {
+		return listing{}, "", nil, fmt.Errorf("t must be one of hour, day, week, month, year or all")
+	} else if l.Time == "" && sort == "top" {
+		l.Time = "day"
+	} else if l.Time != "" && sort != "top" {
+		return listing{}, "", nil, fmt.Errorf("t can only be used with the score rank")
+	}
+
+	subreddits, err := parseSubreddits(queryParams.Get("subreddits"))
+	if err != nil {
+		return listing{}, "", nil, err
+	}
+
+	sources := []sourceCursor{}
+	for _, sub := range subreddits {
+		sources = append(sources, sourceCursor{Subreddit: sub})
+	}
+	return l, rank, sources, nil
+}
+
+// Reddit's hot formula, newer posts need exponentially more votes to outrank older ones
+func hotScore(post RedditPost) float64 {
+	order := math.Log10(math.Max(math.Abs(float64(post.Score)), 1))
+	sign := 0.0
+	if post.Score > 0 {
+		sign = 1
+	} else if post.Score < 0 {
+		sign = -1
+	}
+	return sign*order + (post.UnixTime-hotEpoch)/45000
+}
+
+// Gets the value posts are ordered by for the given rank, higher values come first
+func rankValue(rank string, post RedditPost, now float64) float64 {
+	switch rank {
+	case rankRecency:
+		return post.UnixTime
+	case rankScore:
+		return float64(post.Score)
+	case rankScorePerHour:
+		// Posts younger than an hour are treated as an hour old so brand new posts don't jump to the top
+		hours := math.Max((now-post.UnixTime)/3600, 1)
+		return float64(post.Score) / hours
+	default:
+		return hotScore(post)
+	}
+}
+
+// Merges the posts of every source by repeatedly taking the best post from the front of a source.
+// Returns the merged posts and how many were taken from each source
+func mergeSources(batches [][]RedditPost, rank string, limit int, now float64, sent map[string]bool) ([]RedditPost, []int) {
+	if rank == rankScorePerHour {
+		return rankSources(batches, rank, limit, now, sent)
+	}
+
+	taken := make([]int, len(batches))
+	merged := []RedditPost{}
+	for len(merged) < limit {
+		best := -1
+		var bestValue float64
+		for i, batch := range batches {
+			if taken[i] >= len(batch) {
+				continue
+			}
+			value := rankValue(rank, batch[taken[i]], now)
+			if best == -1 || value > bestValue {
+				best, bestValue = i, value
+			}
+		}
+		if best == -1 {
+			break
+		}
+		merged = append(merged, batches[best][taken[best]])
+		taken[best]++
+	}
+	return merged, taken
+}
+
+// Ranks every post fetched that hasn't already been sent and takes the best of them. Posts can be taken
+// from anywhere in a source so each one is only used up to its first post that is neither taken nor sent,
+// the rest are fetched again for the next page where those already sent are left out
+func rankSources(batches [][]RedditPost, rank string, limit int, now float64, sent map[string]bool) ([]RedditPost, []int) {
+	ranked := []RedditPost{}
+	for _, batch := range batches {
+		for _, post := range batch {
+			if !sent[post.ID] {
+				ranked = append(ranked, post)
+			}
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return rankValue(rank, ranked[i], now) > rankValue(rank, ranked[j], now)
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	used := map[string]bool{}
+	for _, post := range ranked {
+		used[post.ID] = true
+	}
+	taken := make([]int, len(batches))
+	for i, batch := range batches {
+		for taken[i] < len(batch) && (used[batch[taken[i]].ID] || sent[batch[taken[i]].ID]) {
+			taken[i]++
+		}
+	}
+	return ranked, taken
+}
+
+// Fetches the next posts of every source that isn't done at the same time
+func (api *CoreHandler) fetchSources(auth *AuthRequest, userID string, l listing, sources []sourceCursor, limit int) []sourceBatch {
+	batches := make([]sourceBatch, len(sources))
+
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		if source.Done {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, source sourceCursor) {
+			defer wg.Done()
+
+			sub := listing{Type: listingSubreddit, Subreddit: source.Subreddit, Sort: l.Sort, Time: l.Time}
+			vals, err := api.fetchListing(auth, userID, sub, sub.query(source.After, "", source.Count, limit))
+			if err != nil {
+				batches[i].err = err
+				return
+			}
+			for _, c := range vals.Data.Children {
+				batches[i].posts = append(batches[i].posts, c.Data)
+			}
+			batches[i].after = vals.Data.After
+		}(i, source)
+	}
+	wg.Wait()
+
+	return batches
+}
+
+// Fetches several subreddits and merges them into a single ranked timeline
+// GET /v1/{id}/timeline
+func (api *CoreHandler) GetTimeline(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	id := mux.Vars(r)["id"]
+
+	opts, err := getPostOptions(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cursor := &pageCursor{UserID: id}
+	if token := queryParams.Get("continue"); token != "" {
+		if cursor, err = api.cursors.Decode(token, id); err != nil || cursor.Listing.Type != listingTimeline {
+			http.Error(w, errInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if cursor.Listing, cursor.Rank, cursor.Sources, err = getTimeline(queryParams); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts.filters = api.resolveFilters(opts.filters, id, redditAuth)
+
+	limit := opts.limit
+	if limit == 0 {
+		limit = defaultListingLimit
+	}
+
+	batches := api.fetchSources(redditAuth, id, cursor.Listing, cursor.Sources, limit)
+	posts := make([][]RedditPost, len(batches))
+	active, failed := 0, 0
+	for i, batch := range batches {
+		if !cursor.Sources[i].Done {
+			active++
+		}
+		if batch.err != nil {
+			// A single broken subreddit shouldn't take down the whole timeline, it is retried on the next page
+			log.Printf("Unable to fetch r/%v for timeline: %v", cursor.Sources[i].Subreddit, batch.err)
+			failed++
+		}
+		posts[i] = batch.posts
+	}
+	if active > 0 && failed == active {
+		http.Error(w, "unable to fetch any of the subreddits", http.StatusBadGateway)
+		return
+	}
+
+	seen, sessionFound := api.getSeenPosts(cursor.Session)
+	sent := map[string]bool{}
+	for _, id := range seen.IDs {
+		sent[id] = true
+	}
+	merged, taken := mergeSources(posts, cursor.Rank, limit, float64(time.Now().Unix()), sent)
+
+	// Each source only moves past the posts we actually used so nothing is skipped on the next page
+	next := pageCursor{Listing: cursor.Listing, Rank: cursor.Rank, UserID: id}
+	more := false
+	for i, source := range cursor.Sources {
+		batch := batches[i]
+		if batch.err == nil && !source.Done {
+			if taken[i] > 0 {
+				source.After = linkPrefix + batch.posts[taken[i]-1].ID
+				source.Count += taken[i]
+			}
+			source.Done = taken[i] == len(batch.posts) && batch.after == ""
+		}
+		more = more || !source.Done
+		next.Sources = append(next.Sources, source)
+	}
+
+	muted := newMuteMatcher(api.store.Get(id).MuteRules)
+	page, deduper := buildPage(merged, opts, muted, seen, map[string]*Post{})
+
+	if opts.linkPreviews {
+		api.previews.Enrich(page)
+	}
+
+	var nextURL string
+	if more {
+		next.Session = api.saveSeenPosts(deduper.snapshot())
+		if nextURL, err = api.getPageURL(r, next); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	res, err := json.Marshal(ClientResp{Posts: page, NextURL: nextURL, SessionExpired: !sessionFound})
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (s *HandlersTestSuite) TestMergeSources() {
+	a := []RedditPost{{ID: "a1", Score: 50}, {ID: "a2", Score: 10}}
+	b := []RedditPost{{ID: "b1", Score: 30}, {ID: "b2", Score: 20}, {ID: "b3", Score: 5}}
+
+	merged, taken := mergeSources([][]RedditPost{a, b}, rankScore, 4, 0, nil)
+	ids := []string{}
+	for _, post := range merged {
+		ids = append(ids, post.ID)
+	}
+	s.Equal([]string{"a1", "b1", "b2", "a2"}, ids)
+	s.Equal([]int{2, 2}, taken)
+
+	// A source can only be taken from the front so a later post never jumps ahead of an earlier one
+	merged, taken = mergeSources([][]RedditPost{{{ID: "low", Score: 1}, {ID: "high", Score: 100}}}, rankScore, 1, 0, nil)
+	s.Equal("low", merged[0].ID)
+	s.Equal([]int{1}, taken)
+}
+
+func (s *HandlersTestSuite) TestMergeSourcesScorePerHour() {
+	now := float64(1500000000)
+	// Sources come newest first so the best posts can be anywhere in them
+	a := []RedditPost{{ID: "a1", Score: 1, UnixTime: now - 600}, {ID: "a2", Score: 6000, UnixTime: now - 2*3600}, {ID: "a3", Score: 3, UnixTime: now - 3*3600}}
+	b := []RedditPost{{ID: "b1", Score: 50, UnixTime: now - 1800}, {ID: "b2", Score: 900, UnixTime: now - 3*3600}}
+
+	merged, taken := mergeSources([][]RedditPost{a, b}, rankScorePerHour, 3, now, nil)
+	ids := []string{}
+	for _, post := range merged {
+		ids = append(ids, post.ID)
+	}
+	s.Equal([]string{"a2", "b2", "b1"}, ids)
+	// a1 hasn't been sent so a can't move past it yet
+	s.Equal([]int{0, 2}, taken)
+
+	// Posts sent on earlier pages are left out and no longer hold their source back
+	merged, taken = mergeSources([][]RedditPost{a, b[2:]}, rankScorePerHour, 3, now, map[string]bool{"a2": true, "b1": true, "b2": true})
+	ids = []string{}
+	for _, post := range merged {
+		ids = append(ids, post.ID)
+	}
+	s.Equal([]string{"a1", "a3"}, ids)
+	s.Equal([]int{3, 0}, taken)
+}
+
+func (s *HandlersTestSuite) TestRankValue() {
+	now := float64(1500000000)
+	old := RedditPost{Score: 100, UnixTime: now - 10*3600}
+	fresh := RedditPost{Score: 20, UnixTime: now - 3600}
+
+	s.True(rankValue(rankScore, old, now) > rankValue(rankScore, fresh, now))
+	s.True(rankValue(rankRecency, fresh, now) > rankValue(rankRecency, old, now))
+	s.True(rankValue(rankScorePerHour, fresh, now) > rankValue(rankScorePerHour, old, now))
+	// A day of age is worth a couple of orders of magnitude of votes in reddit's hot formula
+	s.True(rankValue(rankHot, RedditPost{Score: 10, UnixTime: now}, now) > rankValue(rankHot, RedditPost{Score: 100, UnixTime: now - 24*3600}, now))
+}
+
+func (s *HandlersTestSuite) TestGetTimeline() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/timeline?subreddits=timelinea,r/timelineb&rank=recency&limit=10", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("new", s.lastListing.Path[strings.LastIndex(s.lastListing.Path, "/")+1:])
+
+	resp := ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 10)
+	s.Equal("timelinea_p0", resp.Posts[0].ID)
+	s.Equal("timelineb_p0", resp.Posts[1].ID)
+	s.Equal("timelineb_p4", resp.Posts[9].ID)
+
+	// Every subreddit should carry on from the last post we took from it
+	next, err := url.Parse(resp.NextURL)
+	s.Nil(err)
+	s.Empty(next.Query().Get("subreddits"))
+	w = s.serveAPI(http.MethodGet, next.RequestURI(), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	resp = ClientResp{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Posts, 10)
+	s.Equal("timelinea_p5", resp.Posts[0].ID)
+	s.Equal("timelineb_p5", resp.Posts[1].ID)
+
+	// Timeline cursors can't be used to page through other listings
+	w = s.serveAPI(http.MethodGet, strings.Replace(next.RequestURI(), "/timeline", "/posts", 1), `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetTimelineInvalid() {
+	tooMany := []string{}
+	for i := 0; i <= maxTimelineSources; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("sub%v", i))
+	}
+
+	for _, query := range []string{
+		"",
+		"subreddits=golang&rank=random",
+		"subreddits=golang&rank=hot&t=week",
+		"subreddits=golang%2Brust",
+		"subreddits=" + strings.Join(tooMany, ","),
+	} {
+		w := s.serveAPI(http.MethodGet, "/v1/user/timeline?"+query, `{"bearer-token": "bearer"}`)
+		s.Equal(http.StatusBadRequest, w.Code, query)
+	}
+}
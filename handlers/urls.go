@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Query params that only exist to track clicks and never change what a url points to
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+	"ref_src": true,
+	"ref_url": true,
+}
+
+// Params that are only tracking on certain sites, elsewhere they may well matter
+var siteTrackingParams = map[string]map[string]bool{
+	"twitter.com":      {"s": true, "t": true},
+	"x.com":            {"s": true, "t": true},
+	"www.youtube.com":  {"si": true, "feature": true},
+	"youtu.be":         {"si": true, "feature": true},
+	"open.spotify.com": {"si": true},
+}
+
+// Hosts that have more than one name, including their mobile sites. Only hosts listed here are
+// rewritten as m. and mobile. are ordinary names on plenty of other sites
+var canonicalHosts = map[string]string{
+	"reddit.com":           "www.reddit.com",
+	"old.reddit.com":       "www.reddit.com",
+	"new.reddit.com":       "www.reddit.com",
+	"np.reddit.com":        "www.reddit.com",
+	"i.reddit.com":         "www.reddit.com",
+	"m.reddit.com":         "www.reddit.com",
+	"youtube.com":          "www.youtube.com",
+	"m.youtube.com":        "www.youtube.com",
+	"facebook.com":         "www.facebook.com",
+	"m.facebook.com":       "www.facebook.com",
+	"mobile.twitter.com":   "twitter.com",
+	"m.twitter.com":        "twitter.com",
+	"mobile.x.com":         "x.com",
+	"m.imdb.com":           "www.imdb.com",
+	"mobile.nytimes.com":   "www.nytimes.com",
+	"m.huffingtonpost.com": "www.huffingtonpost.com",
+}
+
+// Sites known to serve amp copies of their pages, and where the normal pages live. Amp path segments,
+// suffixes and params are only removed on these hosts as elsewhere they may be part of the real url
+var ampHosts = map[string]string{
+	"amp.reddit.com":         "www.reddit.com",
+	"amp.theguardian.com":    "www.theguardian.com",
+	"amp.cnn.com":            "www.cnn.com",
+	"www.bbc.co.uk":          "www.bbc.co.uk",
+	"www.bbc.com":            "www.bbc.com",
+	"www.washingtonpost.com": "www.washingtonpost.com",
+}
+
+func isTrackingParam(host, key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "utm_") || trackingParams[key] || siteTrackingParams[host][key]
+}
+
+// Gets the url an amp link is a copy of, returns false if it isn't served by an amp cache
+func getAMPOrigin(u *url.URL) (string, bool) {
+	var rest string
+	switch {
+	case u.Host == "www.google.com" && strings.HasPrefix(u.Path, "/amp/"):
+		rest = strings.TrimPrefix(u.Path, "/amp/")
+	case strings.HasSuffix(u.Host, ".cdn.ampproject.org"):
+		// The path is /c/ followed by /s/ when the origin is https, e.g. /c/s/example.com/article
+		rest = strings.TrimPrefix(strings.TrimPrefix(u.Path, "/v"), "/c/")
+	default:
+		return "", false
+	}
+
+	scheme := "http://"
+	if strings.HasPrefix(rest, "s/") {
+		scheme, rest = "https://", strings.TrimPrefix(rest, "s/")
+	}
+	if rest == "" {
+		return "", false
+	}
+	return scheme + rest, true
+}
+
+// Removes amp markers from the host and path of urls on known amp sites, returns false for any other url
+func stripAMP(u *url.URL) bool {
+	host, ok := ampHosts[u.Host]
+	if !ok {
+		return false
+	}
+	u.Host = host
+
+	segments := strings.Split(u.Path, "/")
+	kept := segments[:0]
+	for _, s := range segments {
+		if s == "amp" {
+			continue
+		}
+		s = strings.TrimSuffix(strings.TrimSuffix(s, ".amp.html"), ".amp")
+		kept = append(kept, s)
+	}
+	path := strings.Join(kept, "/")
+	if path == "" && u.Path != "" {
+		path = "/"
+	}
+	if path != u.Path {
+		u.Path, u.RawPath = path, ""
+	}
+	return true
+}
+
+// Canonicalizes an outbound url, removing trackers, amp caches and the amp and mobile versions of sites we
+// know about so the same page always gets the same url. Urls we can't parse are returned unescaped but
+// otherwise untouched
+func normalizeURL(raw string) string {
+	link := strings.TrimSpace(html.UnescapeString(raw))
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return link
+	}
+	u.Host = strings.ToLower(u.Host)
+
+	if origin, ok := getAMPOrigin(u); ok {
+		if o, err := url.Parse(origin); err == nil && o.Host != "" {
+			if o.RawQuery == "" {
+				o.RawQuery = u.RawQuery
+			}
+			u = o
+			u.Host = strings.ToLower(u.Host)
+		}
+	}
+
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	if strings.HasSuffix(u.Host, ".m.wikipedia.org") {
+		u.Host = strings.TrimSuffix(u.Host, ".m.wikipedia.org") + ".wikipedia.org"
+	}
+	amp := stripAMP(u)
+	if host, ok := canonicalHosts[u.Host]; ok {
+		u.Host = host
+	}
+
+	// Filter the raw query rather than re-encoding it so params we keep are left exactly as they were
+	if u.RawQuery != "" {
+		params := []string{}
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			key := param
+			if i := strings.Index(param, "="); i >= 0 {
+				key = param[:i]
+			}
+			isAMPParam := amp && (key == "amp" || (key == "outputType" && strings.HasSuffix(param, "=amp")))
+			if param == "" || isTrackingParam(u.Host, key) || isAMPParam {
+				continue
+			}
+			params = append(params, param)
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+
+	return u.String()
+}
+
+// Gets the key used to tell whether two posts link to the same page. It ignores differences
+// that never matter such as the scheme, www, a trailing slash or the order of query params
+func getURLKey(link string) string {
+	u, err := url.Parse(normalizeURL(link))
+	if err != nil || u.Host == "" {
+		return link
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	sort.Strings(params)
+	key := strings.TrimPrefix(u.Host, "www.") + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		key += "?" + strings.Join(params, "&")
+	}
+	return key
+}
@@ -0,0 +1,49 @@
+package handlers
+
+func (s *HandlersTestSuite) TestNormalizeURL() {
+	cases := map[string]string{
+		"https://example.com/article?utm_source=reddit&amp;id=5&amp;fbclid=abc": "https://example.com/article?id=5",
+		"https://EXAMPLE.com:443/a?b=1":                                         "https://example.com/a?b=1",
+		"https://www.google.com/amp/s/www.bbc.co.uk/news/world-123.amp":         "https://www.bbc.co.uk/news/world-123",
+		"https://www-example-com.cdn.ampproject.org/c/s/www.example.com/story":  "https://www.example.com/story",
+		// The cache is removed but the origin's own path is left alone
+		"https://www-example-com.cdn.ampproject.org/c/s/www.example.com/amp/story": "https://www.example.com/amp/story",
+		"https://amp.theguardian.com/world/2018/story?amp=1":                       "https://www.theguardian.com/world/2018/story",
+		"https://amp.reddit.com/r/golang/comments/abc/":                            "https://www.reddit.com/r/golang/comments/abc/",
+		"https://m.youtube.com/watch?v=abc&amp;feature=share":                      "https://www.youtube.com/watch?v=abc",
+		"https://mobile.twitter.com/golang/status/1?s=20&amp;t=xyz":                "https://twitter.com/golang/status/1",
+		"https://en.m.wikipedia.org/wiki/Go_(programming_language)":                "https://en.wikipedia.org/wiki/Go_(programming_language)",
+		"https://old.reddit.com/r/golang/comments/abc/":                            "https://www.reddit.com/r/golang/comments/abc/",
+		"https://example.com/search?q=a+b&amp;t=10":                                "https://example.com/search?q=a+b&t=10",
+		"mailto:someone@example.com":                                               "mailto:someone@example.com",
+	}
+
+	for raw, expected := range cases {
+		s.Equal(expected, normalizeURL(raw), raw)
+	}
+
+	// Amp and mobile markers on sites we don't know about are part of the real url
+	for _, link := range []string{
+		"https://amp.dev/documentation/guides",
+		"https://m.me/someone",
+		"https://mobile.example.com/page",
+		"https://github.com/ampproject/amp",
+		"https://www.reddit.com/r/amp/",
+		"https://example.com/news/story.amp",
+		"https://example.com/page?amp=5",
+	} {
+		s.Equal(link, normalizeURL(link), link)
+	}
+
+	// The original url should be exactly what was posted, without reddit's escaping
+	post, ok := newPost(RedditPost{URL: "https://example.com/a?b=1&amp;utm_source=reddit"}, &postOptions{targetWidth: targetImageWidth})
+	s.True(ok)
+	s.Equal("https://example.com/a?b=1", post.URL)
+	s.Equal("https://example.com/a?b=1&utm_source=reddit", post.OriginalURL)
+}
+
+func (s *HandlersTestSuite) TestGetURLKey() {
+	s.Equal(getURLKey("https://example.com/a/?b=2&c=3"), getURLKey("http://www.example.com/a?c=3&b=2&utm_medium=social"))
+	s.Equal(getURLKey("https://youtu.be/abc?si=xyz"), getURLKey("https://youtu.be/abc"))
+	s.NotEqual(getURLKey("https://example.com/a?b=1"), getURLKey("https://example.com/a?b=2"))
+}
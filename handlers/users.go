@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	usernameAvailableEndpoint = "/api/username_available"
+
+	userActive    = "active"
+	userSuspended = "suspended"
+	// Reddit says the account doesn't exist but its name is taken. This is how shadowbanned accounts look,
+	// but deleted accounts look exactly the same so we can't say which it is
+	userUnavailable = "unavailable"
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,20}$`)
+
+type RedditUserAbout struct {
+	Kind string           `json:"kind"`
+	Data IdentityResponse `json:"data"`
+}
+
+type Karma struct {
+	Post    int `json:"post"`
+	Comment int `json:"comment"`
+	Awarder int `json:"awarder"`
+	Awardee int `json:"awardee"`
+	Total   int `json:"total"`
+}
+
+type Profile struct {
+	Name        string     `json:"name"`
+	Avatar      string     `json:"avatar,omitempty"`
+	Snoovatar   string     `json:"snoovatar,omitempty"`
+	Banner      string     `json:"banner,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	Karma       *Karma     `json:"karma,omitempty"`
+	Verified    bool       `json:"verified"`
+	Gold        bool       `json:"gold"`
+	Moderator   bool       `json:"moderator"`
+	Employee    bool       `json:"employee"`
+	NSFW        bool       `json:"nsfw"`
+	// One of active, suspended or unavailable, only active users have anything beyond their name.
+	// Unavailable accounts have either been shadowbanned or deleted
+	Status string `json:"status"`
+	Link   string `json:"link"`
+}
+
+// Maps an account from Reddit into our profile
+func newProfile(user IdentityResponse) *Profile {
+	profile := &Profile{
+		Name:   user.RedditUsername,
+		Status: userActive,
+		Link:   redditBaseURL + "/user/" + user.RedditUsername,
+	}
+	// Suspended accounts come back with nothing but their name
+	if user.IsSuspended {
+		profile.Status = userSuspended
+		return profile
+	}
+
+	created := redditTime(user.UnixTime)
+	profile.Created = &created
+	profile.Avatar = getThumbnail(user.IconImg)
+	profile.Snoovatar = getThumbnail(user.SnoovatarImg)
+	profile.Karma = &Karma{
+		Post:    user.LinkKarma,
+		Comment: user.CommentKarma,
+		Awarder: user.AwarderKarma,
+		Awardee: user.AwardeeKarma,
+		Total:   user.TotalKarma,
+	}
+	profile.Verified = user.Verified
+	profile.Gold = user.IsGold
+	profile.Moderator = user.IsMod
+	profile.Employee = user.IsEmployee
+	if user.Subreddit != nil {
+		profile.Banner = getThumbnail(user.Subreddit.BannerImg)
+		profile.Description = user.Subreddit.PublicDescription
+		profile.NSFW = user.Subreddit.Over18
+	}
+	return profile
+}
+
+// Gets the profile of any Reddit user. Reddit says shadowbanned and deleted users don't exist, but their
+// names are still taken, which is how we tell them apart from names nobody has ever registered
+func (api *CoreHandler) getProfile(auth *AuthRequest, userID, name string) (*Profile, error) {
+	about := &RedditUserAbout{}
+	err := api.getRedditJSON(auth, userID, "/user/"+name+"/about", "", about)
+	statusErr, ok := err.(*redditStatusError)
+	if err == nil {
+		return newProfile(about.Data), nil
+	} else if !ok || statusErr.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+
+	var available bool
+	query := "?" + url.Values{"user": {name}}.Encode()
+	if err := api.getRedditJSON(auth, userID, usernameAvailableEndpoint, query, &available); err != nil {
+		return nil, err
+	} else if available {
+		return nil, statusErr
+	}
+	return &Profile{Name: name, Status: userUnavailable, Link: redditBaseURL + "/user/" + name}, nil
+}
+
+func writeProfile(w http.ResponseWriter, profile *Profile) {
+	res, err := json.Marshal(profile)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Gets the public profile of a Reddit user
+// GET /v1/users/{redditName}
+func (api *CoreHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	name := vars["redditName"]
+	if !usernamePattern.MatchString(name) {
+		http.Error(w, "invalid reddit username", http.StatusBadRequest)
+		return
+	}
+
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := api.getProfile(redditAuth, vars["id"], name)
+	if err != nil {
+		log.Printf("Unable to get profile of u/%v: %v", name, err)
+		writeRedditError(w, err)
+		return
+	}
+
+	writeProfile(w, profile)
+}
+
+// Gets the profile of the Reddit account the user has linked
+// GET /v1/{id}/me
+func (api *CoreHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	redditAuth, err := api.getRedditAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if redditAuth.BearerToken == "" {
+		http.Error(w, "a reddit account must be linked", http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := api.GetIdentity(redditAuth, mux.Vars(r)["id"])
+	if err != nil {
+		writeRedditError(w, err)
+		return
+	}
+
+	writeProfile(w, newProfile(*identity))
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *HandlersTestSuite) TestGetUser() {
+	w := s.serveAPI(http.MethodGet, "/v1/users/spez", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	profile := Profile{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &profile))
+	s.Equal("spez", profile.Name)
+	s.Equal(userActive, profile.Status)
+	s.Equal("https://styles.redditmedia.com/avatar.png?width=256&s=abc", profile.Avatar)
+	s.Equal(int64(1500000000), profile.Created.Unix())
+	s.Equal(Karma{Post: 10, Comment: 20, Total: 30}, *profile.Karma)
+	s.True(profile.Verified)
+	s.True(profile.Gold)
+	s.Equal("Hi", profile.Description)
+	s.Equal("https://www.reddit.com/user/spez", profile.Link)
+
+	w = s.serveAPI(http.MethodGet, "/v1/users/suspended", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	profile = Profile{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &profile))
+	s.Equal(userSuspended, profile.Status)
+	s.Nil(profile.Karma)
+
+	// Users reddit says don't exist are unavailable if their name has been taken
+	w = s.serveAPI(http.MethodGet, "/v1/users/shadowbanned", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+	profile = Profile{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &profile))
+	s.Equal(userUnavailable, profile.Status)
+
+	w = s.serveAPI(http.MethodGet, "/v1/users/nobody", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusNotFound, w.Code)
+
+	w = s.serveAPI(http.MethodGet, "/v1/users/a.b", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlersTestSuite) TestGetMe() {
+	w := s.serveAPI(http.MethodGet, "/v1/user/me", `{"bearer-token": "bearer"}`)
+	s.Equal(http.StatusOK, w.Code)
+
+	profile := Profile{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &profile))
+	s.Equal("test", profile.Name)
+	s.Equal(1200, profile.Karma.Total)
+
+	// Without a linked account there is nobody to get
+	w = s.serveAPI(http.MethodGet, "/v1/user/me", "")
+	s.Equal(http.StatusUnauthorized, w.Code)
+}
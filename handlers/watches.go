@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+const (
+	maxWatches        = 50
+	watchPollInterval = time.Minute
+	// Posts delivered for a watch that we remember so they are never sent twice
+	maxWatchDeliveries = 500
+
+	webhookAttempts   = 5
+	webhookRetryDelay = 2 * time.Second
+	webhookTimeout    = 10 * time.Second
+)
+
+// Notifies core when posts matching the rule appear in a subreddit
+type Watch struct {
+	ID        string `json:"id"`
+	Subreddit string `json:"subreddit"`
+	// Only match posts with this word in the title
+	Keyword string `json:"keyword,omitempty"`
+	// Only match posts with at least this score
+	MinScore int `json:"minScore,omitempty"`
+	// Where deliveries are sent, must be one of the webhook urls we have been configured with
+	Webhook string `json:"webhook"`
+	// Posts made before the watch was created never match
+	Created float64 `json:"created"`
+}
+
+// What we send to a watch's webhook
+type WatchDelivery struct {
+	ID      string `json:"id"`
+	WatchID string `json:"watchID"`
+	UserID  string `json:"userID"`
+	Post    Post   `json:"post"`
+}
+
+// A delivery that has either reached core or been given up on
+type finishedDelivery struct {
+	id      string
+	userID  string
+	watchID string
+	postID  string
+}
+
+// Runs every users watches against Reddit in the background and delivers what they match
+type watchRunner struct {
+	store  *userStore
+	client *http.Client
+	secret []byte
+	// Subreddits are fetched through the stream hub so watches and streams share its request budget
+	streams *streamHub
+	// The first delay between attempts to deliver a webhook, doubled after each failure
+	retryDelay time.Duration
+
+	mu sync.Mutex
+	// Deliveries that are still being attempted or haven't been recorded yet so later polls don't start them again
+	pending map[string]bool
+	// Deliveries waiting to be recorded at the start of the next poll
+	finished []finishedDelivery
+	wg       sync.WaitGroup
+}
+
+func newWatchRunner(store *userStore, client *http.Client, secret string, streams *streamHub) *watchRunner {
+	return &watchRunner{
+		store:      store,
+		client:     client,
+		secret:     []byte(secret),
+		streams:    streams,
+		retryDelay: webhookRetryDelay,
+		pending:    map[string]bool{},
+	}
+}
+
+func (watch *Watch) validate(webhooks []string) error {
+	watch.Subreddit = normalizeMuteValue(muteSubreddit, watch.Subreddit)
+	if !subredditPattern.MatchString(watch.Subreddit) || strings.Contains(watch.Subreddit, "+") {
+		return fmt.Errorf("invalid subreddit name")
+	}
+
+	watch.Keyword = strings.TrimSpace(watch.Keyword)
+	if len(watch.Keyword) > maxMuteValueSize {
+		return fmt.Errorf("keyword must be at most %v characters", maxMuteValueSize)
+	}
+	if watch.MinScore < 0 {
+		return fmt.Errorf("minScore must not be negative")
+	}
+
+	if len(webhooks) == 0 {
+		return fmt.Errorf("no webhook urls have been configured")
+	}
+	if watch.Webhook == "" {
+		watch.Webhook = webhooks[0]
+	}
+	for _, webhook := range webhooks {
+		if watch.Webhook == webhook {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook must be one of the configured webhook urls")
+}
+
+// Whether the post matches the watch, keywords only match whole words like mute rules do
+func (watch Watch) matches(post RedditPost, keyword *regexp.Regexp) bool {
+	if !strings.EqualFold(post.Subreddit, watch.Subreddit) || post.UnixTime < watch.Created {
+		return false
+	}
+	if watch.MinScore > 0 && post.Score < watch.MinScore {
+		return false
+	}
+	return keyword == nil || keyword.MatchString(html.UnescapeString(post.Title))
+}
+
+// Signs the timestamp and body so core can check deliveries came from us and aren't being replayed
+func (wr *watchRunner) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, wr.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends the delivery, returns whether it is worth trying again after a failure
+func (wr *watchRunner) send(webhook string, delivery WatchDelivery, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delivery-ID", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", wr.sign(timestamp, body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	resp, err := wr.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook responded with %v", resp.StatusCode)
+	// Anything else is a problem with the delivery itself that retrying won't fix
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Delivers the post with retries. Deliveries that fail for good are recorded just like those core has
+// accepted as sending them again would only fail the same way
+func (wr *watchRunner) deliver(userID string, watch Watch, postID string, delivery WatchDelivery) {
+	defer wr.wg.Done()
+	defer func() {
+		wr.mu.Lock()
+		wr.finished = append(wr.finished, finishedDelivery{id: delivery.ID, userID: userID, watchID: watch.ID, postID: postID})
+		wr.mu.Unlock()
+	}()
+
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		log.Printf("Unable to marshall watch delivery: %v", err)
+		return
+	}
+
+	delay := wr.retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := wr.send(watch.Webhook, delivery, body)
+		if err == nil {
+			break
+		}
+		if !retry || attempt == webhookAttempts {
+			log.Printf("Giving up on delivery %v after %v attempts: %v", delivery.ID, attempt, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Records every delivery that has finished against its watch with a single save
+func (wr *watchRunner) recordDeliveries() {
+	wr.mu.Lock()
+	finished := wr.finished
+	wr.finished = nil
+	wr.mu.Unlock()
+	if len(finished) == 0 {
+		return
+	}
+
+	byUser := map[string][]finishedDelivery{}
+	userIDs := []string{}
+	for _, f := range finished {
+		if _, ok := byUser[f.userID]; !ok {
+			userIDs = append(userIDs, f.userID)
+		}
+		byUser[f.userID] = append(byUser[f.userID], f)
+	}
+
+	err := wr.store.UpdateUsers(userIDs, func(userID string, data *UserData) {
+		// Build a new map as readers may still hold the old one
+		deliveries := make(map[string][]string, len(data.WatchDeliveries)+1)
+		for id, posts := range data.WatchDeliveries {
+			deliveries[id] = posts
+		}
+		watches := map[string]bool{}
+		for _, watch := range data.Watches {
+			watches[watch.ID] = true
+		}
+		for _, f := range byUser[userID] {
+			// The watch may have been deleted while we were delivering
+			if !watches[f.watchID] {
+				continue
+			}
+			posts := append(append([]string{}, deliveries[f.watchID]...), f.postID)
+			if len(posts) > maxWatchDeliveries {
+				posts = posts[len(posts)-maxWatchDeliveries:]
+			}
+			deliveries[f.watchID] = posts
+		}
+		data.WatchDeliveries = deliveries
+	})
+	if err != nil {
+		log.Printf("Unable to record %v watch deliveries: %v", len(finished), err)
+	}
+
+	// The store holds them now even if saving failed so the next poll won't send them again
+	wr.mu.Lock()
+	for _, f := range finished {
+		delete(wr.pending, f.id)
+	}
+	wr.mu.Unlock()
+}
+
+// Checks every watch against the latest posts of its subreddit and starts delivering any new matches.
+// Returns how many requests were made to Reddit
+func (wr *watchRunner) poll() int {
+	wr.recordDeliveries()
+
+	type userWatch struct {
+		userID    string
+		watch     Watch
+		keyword   *regexp.Regexp
+		delivered map[string]bool
+	}
+
+	// Group the watches by subreddit so each subreddit is only fetched once
+	bySubreddit := map[string][]userWatch{}
+	wantsScore := map[string]bool{}
+	for userID, data := range wr.store.All() {
+		for _, watch := range data.Watches {
+			uw := userWatch{userID: userID, watch: watch, delivered: map[string]bool{}}
+			if watch.Keyword != "" {
+				uw.keyword = regexp.MustCompile(`(?i)(^|\W)` + regexp.QuoteMeta(watch.Keyword) + `(\W|$)`)
+			}
+			for _, id := range data.WatchDeliveries[watch.ID] {
+				uw.delivered[id] = true
+			}
+			sub := strings.ToLower(watch.Subreddit)
+			bySubreddit[sub] = append(bySubreddit[sub], uw)
+			wantsScore[sub] = wantsScore[sub] || watch.MinScore > 0
+		}
+	}
+
+	opts := &postOptions{
+		targetWidth:   targetImageWidth,
+		contentFormat: contentFormatHTML,
+		excerptLength: defaultExcerptLength,
+		// Core decides what to do with sensitive posts so we send everything as it is
+		filters: FilterSettings{NSFW: filterShow, Spoilers: filterShow, Quarantine: filterShow},
+	}
+
+	requests := 0
+	for sub, watches := range bySubreddit {
+		// New posts rarely have much score yet, watches with a minimum also need the posts that have been voted up
+		sorts := []string{"new"}
+		if wantsScore[sub] {
+			sorts = append(sorts, "hot")
+		}
+
+		posts := []RedditPost{}
+		for _, sort := range sorts {
+			l := listing{Type: listingSubreddit, Subreddit: sub, Sort: sort}
+			requests++
+			vals, err := wr.streams.fetch(l, l.query("", "", 0, maxListingLimit))
+			if err != nil {
+				log.Printf("Unable to fetch r/%v for watches: %v", sub, err)
+				continue
+			}
+			for _, c := range vals.Data.Children {
+				posts = append(posts, c.Data)
+			}
+		}
+
+		for _, uw := range watches {
+			for _, post := range posts {
+				if uw.delivered[post.ID] || !uw.watch.matches(post, uw.keyword) {
+					continue
+				}
+
+				delivery := WatchDelivery{ID: uw.watch.ID + ":" + post.ID, WatchID: uw.watch.ID, UserID: uw.userID}
+				wr.mu.Lock()
+				if wr.pending[delivery.ID] {
+					wr.mu.Unlock()
+					continue
+				}
+				wr.pending[delivery.ID] = true
+				wr.mu.Unlock()
+
+				// Posts show up in both listings so only deliver each once per poll
+				uw.delivered[post.ID] = true
+				delivery.Post, _ = newPost(post, opts)
+				wr.wg.Add(1)
+				go wr.deliver(uw.userID, uw.watch, post.ID, delivery)
+			}
+		}
+	}
+	return requests
+}
+
+// Polls the watches until the program exits, polling less often when the request budget is stretched
+func (wr *watchRunner) run() {
+	for {
+		requests := wr.poll()
+		time.Sleep(wr.streams.watchDelay(requests))
+	}
+}
+
+func writeWatches(w http.ResponseWriter, status int, v interface{}) {
+	res, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Unable to marshall response: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(res)
+}
+
+// Parses and validates the watch in the request body
+func (api *CoreHandler) readWatch(r *http.Request) (*Watch, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	watch := &Watch{}
+	if err := json.Unmarshal(body, watch); err != nil {
+		return nil, err
+	}
+
+	return watch, watch.validate(api.conf.WebhookURLs)
+}
+
+// Lists the users watches
+// GET /v1/{id}/watches
+func (api *CoreHandler) GetWatches(w http.ResponseWriter, r *http.Request) {
+	watches := api.store.Get(mux.Vars(r)["id"]).Watches
+	if watches == nil {
+		watches = []Watch{}
+	}
+	writeWatches(w, http.StatusOK, watches)
+}
+
+// Adds a new watch for the user
+// POST /v1/{id}/watches
+func (api *CoreHandler) CreateWatch(w http.ResponseWriter, r *http.Request) {
+	watch, err := api.readWatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if watch.ID, err = newRandomID(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	watch.Created = float64(time.Now().Unix())
+
+	var tooMany bool
+	err = api.store.Update(mux.Vars(r)["id"], func(data *UserData) {
+		if len(data.Watches) >= maxWatches {
+			tooMany = true
+			return
+		}
+		// Always build a new slice as readers may still hold the old one
+		data.Watches = append(append([]Watch{}, data.Watches...), *watch)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if tooMany {
+		http.Error(w, fmt.Sprintf("users can have at most %v watches", maxWatches), http.StatusBadRequest)
+		return
+	}
+
+	writeWatches(w, http.StatusCreated, watch)
+}
+
+// Replaces an existing watch, posts already delivered for it are not sent again
+// PUT /v1/{id}/watches/{watchID}
+func (api *CoreHandler) UpdateWatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	watch, err := api.readWatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	watch.ID = vars["watchID"]
+
+	var found bool
+	err = api.store.Update(vars["id"], func(data *UserData) {
+		watches := make([]Watch, len(data.Watches))
+		for i, existing := range data.Watches {
+			if existing.ID == watch.ID {
+				watch.Created = existing.Created
+				existing = *watch
+				found = true
+			}
+			watches[i] = existing
+		}
+		data.Watches = watches
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "watch not found", http.StatusNotFound)
+		return
+	}
+
+	writeWatches(w, http.StatusOK, watch)
+}
+
+// Removes a watch along with the record of what it delivered
+// DELETE /v1/{id}/watches/{watchID}
+func (api *CoreHandler) DeleteWatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var found bool
+	err := api.store.Update(vars["id"], func(data *UserData) {
+		watches := []Watch{}
+		for _, existing := range data.Watches {
+			if existing.ID == vars["watchID"] {
+				found = true
+				continue
+			}
+			watches = append(watches, existing)
+		}
+		data.Watches = watches
+
+		deliveries := map[string][]string{}
+		for id, posts := range data.WatchDeliveries {
+			if id != vars["watchID"] {
+				deliveries[id] = posts
+			}
+		}
+		data.WatchDeliveries = deliveries
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "watch not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
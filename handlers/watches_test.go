@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+func (s *HandlersTestSuite) TestWatches() {
+	w := s.serveAPI(http.MethodPost, "/v1/watcher/watches", `{"subreddit": "r/Golang", "keyword": "generics", "minScore": 10}`)
+	s.Equal(http.StatusCreated, w.Code)
+
+	watch := Watch{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &watch))
+	s.NotEmpty(watch.ID)
+	s.Equal("golang", watch.Subreddit)
+	// Watches go to the first configured webhook unless they ask for another
+	s.Equal("https://core/v1/webhooks/reddit", watch.Webhook)
+
+	for _, body := range []string{
+		`{"subreddit": "golang", "webhook": "http://169.254.169.254/"}`,
+		`{"subreddit": "golang+rust"}`,
+		`{"subreddit": "golang", "minScore": -1}`,
+	} {
+		w = s.serveAPI(http.MethodPost, "/v1/watcher/watches", body)
+		s.Equal(http.StatusBadRequest, w.Code, body)
+	}
+
+	w = s.serveAPI(http.MethodPut, "/v1/watcher/watches/"+watch.ID, `{"subreddit": "rust"}`)
+	s.Equal(http.StatusOK, w.Code)
+	w = s.serveAPI(http.MethodGet, "/v1/watcher/watches", "")
+	watches := []Watch{}
+	s.Nil(json.Unmarshal(w.Body.Bytes(), &watches))
+	s.Len(watches, 1)
+	s.Equal("rust", watches[0].Subreddit)
+	s.Equal(watch.Created, watches[0].Created)
+
+	w = s.serveAPI(http.MethodDelete, "/v1/watcher/watches/"+watch.ID, "")
+	s.Equal(http.StatusNoContent, w.Code)
+	w = s.serveAPI(http.MethodDelete, "/v1/watcher/watches/"+watch.ID, "")
+	s.Equal(http.StatusNotFound, w.Code)
+}
+
+func (s *HandlersTestSuite) TestWatchRunner() {
+	var mu sync.Mutex
+	attempts, rejected := 0, 0
+	deliveries := []WatchDelivery{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		delivery := WatchDelivery{}
+		json.Unmarshal(body, &delivery)
+
+		// Core refuses some posts outright, those can never be delivered
+		if delivery.Post.ID == "rejected" {
+			rejected++
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Fail the first attempt so the delivery has to be retried
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		runner := &watchRunner{secret: []byte("webhook-secret")}
+		if r.Header.Get("X-Webhook-Signature") != runner.sign(r.Header.Get("X-Webhook-Timestamp"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		deliveries = append(deliveries, delivery)
+	}))
+	defer webhook.Close()
+
+	store, _ := newUserStore("")
+	store.Update("watcher", func(data *UserData) {
+		data.Watches = []Watch{{ID: "w1", Subreddit: "golang", Keyword: "generics", Webhook: webhook.URL, Created: 100}}
+	})
+
+	fetch := func(l listing, query string) (*RedditResponse, error) {
+		resp := &RedditResponse{}
+		for _, post := range []RedditPost{
+			{ID: "match", Subreddit: "golang", Title: "Generics are here", UnixTime: 200},
+			{ID: "old", Subreddit: "golang", Title: "Generics proposal", UnixTime: 50},
+			{ID: "other", Subreddit: "golang", Title: "Modules are here", UnixTime: 200},
+			{ID: "rejected", Subreddit: "golang", Title: "Generics considered harmful", UnixTime: 200},
+		} {
+			resp.Data.Children = append(resp.Data.Children, struct {
+				Data RedditPost `json:"data"`
+			}{post})
+		}
+		return resp, nil
+	}
+
+	runner := newWatchRunner(store, &http.Client{}, "webhook-secret", newStreamHub(fetch))
+	runner.retryDelay = time.Millisecond
+	s.Equal(1, runner.poll())
+	runner.wg.Wait()
+
+	mu.Lock()
+	s.Equal(2, attempts)
+	s.Equal(1, rejected)
+	s.Len(deliveries, 1)
+	s.Equal("w1:match", deliveries[0].ID)
+	s.Equal("watcher", deliveries[0].UserID)
+	s.Equal("match", deliveries[0].Post.ID)
+	mu.Unlock()
+
+	// Deliveries are only recorded once the next poll starts, until then they are still pending
+	s.Empty(store.Get("watcher").WatchDeliveries["w1"])
+	runner.recordDeliveries()
+	recorded := store.Get("watcher").WatchDeliveries["w1"]
+	s.Len(recorded, 2)
+	s.Contains(recorded, "match")
+	s.Contains(recorded, "rejected")
+
+	// Posts that have been delivered or rejected are never sent again
+	runner.poll()
+	runner.wg.Wait()
+	mu.Lock()
+	s.Len(deliveries, 1)
+	s.Equal(1, rejected)
+	mu.Unlock()
+}
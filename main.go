@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/iced-mocha/reddit-client/config"
 	"github.com/iced-mocha/reddit-client/handlers"
@@ -23,6 +27,9 @@ func checkExists(filename string) bool {
 const (
 	certFile = "server.crt"
 	keyFile  = "server.key"
+
+	// How long requests still being handled get to finish when we are asked to exit
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
@@ -46,5 +53,32 @@ func main() {
 		Handler:   s.Router,
 		TLSConfig: &tls.Config{},
 	}
-	log.Fatal(srv.ListenAndServeTLS("/usr/local/etc/ssl/certs/reddit.crt", "/usr/local/etc/ssl/private/reddit.key"))
+
+	// Streams stay open until the client leaves so they have to be ended for shutting down to finish
+	srv.RegisterOnShutdown(handler.CloseStreams)
+
+	// Stop taking requests when asked to exit so we can save anything cached before we go
+	shutdown := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Gave up waiting for requests to finish: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	if err := srv.ListenAndServeTLS("/usr/local/etc/ssl/certs/reddit.crt", "/usr/local/etc/ssl/private/reddit.key"); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// ListenAndServeTLS returns as soon as shutting down starts, the requests still being handled may
+	// yet add to our caches
+	<-shutdown
+	if err := handler.Close(); err != nil {
+		log.Printf("Unable to save caches: %v", err)
+	}
 }
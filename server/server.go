@@ -12,10 +12,47 @@ type Server struct {
 func New(api handlers.CoreAPI) (*Server, error) {
 	s := &Server{Router: mux.NewRouter()}
 
+	// These have to be matched before the routes below take subreddits or users as an id
+	s.Router.HandleFunc("/v1/subreddits", api.GetSubreddits).Methods("GET")
+	s.Router.HandleFunc("/v1/subreddits/{name}", api.GetSubreddit).Methods("GET")
+	s.Router.HandleFunc("/v1/users/{redditName}", api.GetUser).Methods("GET")
+	// Lookups by id share their paths with the listings so they have to be matched first
+	s.Router.HandleFunc("/v1/{id}/posts", api.GetPostsByID).Queries("ids", "{ids}").Methods("GET")
+	s.Router.HandleFunc("/v1/posts", api.GetPostsByID).Queries("ids", "{ids}").Methods("GET")
 	s.Router.HandleFunc("/v1/{id}/posts", api.GetPosts).Methods("GET")
 	s.Router.HandleFunc("/v1/posts", api.GetPostsNoAuth).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}", api.GetPost).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/popular", api.GetPopular).Methods("GET")
+	s.Router.HandleFunc("/v1/popular", api.GetPopular).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/all", api.GetAll).Methods("GET")
+	s.Router.HandleFunc("/v1/all", api.GetAll).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/timeline", api.GetTimeline).Methods("GET")
+	s.Router.HandleFunc("/v1/timeline", api.GetTimeline).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/stream", api.Stream).Methods("GET")
+	s.Router.HandleFunc("/v1/stream", api.Stream).Methods("GET")
 	s.Router.HandleFunc("/v1/authorize_callback", api.AuthorizeCallback).Methods("GET")
 	s.Router.HandleFunc("/v1/{userID}/authorize", api.Authorize).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}/vote", api.Vote).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}/save", api.Save).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}/unsave", api.Unsave).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}/hide", api.Hide).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/posts/{postID}/unhide", api.Unhide).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/subreddits", api.GetSubreddits).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/subreddits/{name}", api.GetSubreddit).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/users/{redditName}", api.GetUser).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/me", api.GetMe).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/subreddits/{name}/submit", api.Submit).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/things/{fullname}/reply", api.Reply).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/settings/filters", api.GetFilterSettings).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/settings/filters", api.UpdateFilterSettings).Methods("PUT")
+	s.Router.HandleFunc("/v1/{id}/mutes", api.GetMuteRules).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/mutes", api.CreateMuteRule).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/mutes/{ruleID}", api.UpdateMuteRule).Methods("PUT")
+	s.Router.HandleFunc("/v1/{id}/mutes/{ruleID}", api.DeleteMuteRule).Methods("DELETE")
+	s.Router.HandleFunc("/v1/{id}/watches", api.GetWatches).Methods("GET")
+	s.Router.HandleFunc("/v1/{id}/watches", api.CreateWatch).Methods("POST")
+	s.Router.HandleFunc("/v1/{id}/watches/{watchID}", api.UpdateWatch).Methods("PUT")
+	s.Router.HandleFunc("/v1/{id}/watches/{watchID}", api.DeleteWatch).Methods("DELETE")
 
 	return s, nil
 }